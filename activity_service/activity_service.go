@@ -1,54 +1,530 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+//runningActivityIndex is unique partial index allowing only one running activity per profile
+const runningActivityIndex = "one_running_activity_per_profile"
+
 type ActivitiesService struct {
 	storage *MongoDbStorage
 }
 
-func (service *ActivitiesService) GetAllActivities(profileId string) (*[]Activity, error) {
+//EnsureIndexes creates indexes required by activity queries.
+//Partial unique index guarantees only one running activity per profile,
+//activities running together in existing data are paused before it is built
+func (service *ActivitiesService) EnsureIndexes() error {
+
+	dbStorage := service.storage
+	db := dbStorage.mgoSession.DB(dbStorage.dbName)
+	activitiesCollection := db.C("activities")
+
+	indexes := []mgo.Index{
+		{Key: []string{"profile_id", "-created_at"}, Background: true},
+		{Key: []string{"profile_id", "begin_time"}, Background: true},
+		{Key: []string{"profile_id", "work_intervals.begin", "work_intervals.end"}, Background: true},
+		{Key: []string{"profile_id", "category"}, Background: true},
+	}
+
+	for _, index := range indexes {
+		if err := activitiesCollection.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+
+	if err := service.pauseConcurrentRunningActivities(); err != nil {
+		return err
+	}
+
+	//partial indexes aren't supported by mgo.Index, each is created by own command so one failure doesn't hide other
+	partialIndexes := []bson.M{
+		{
+			"key":                     bson.M{"profile_id": 1},
+			"name":                    runningActivityIndex,
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"is_started": true},
+		},
+		{
+			"key":                     bson.M{"profile_id": 1, "external_id": 1},
+			"name":                    "unique_external_id_per_profile",
+			"unique":                  true,
+			"partialFilterExpression": bson.M{"external_id": bson.M{"$exists": true}},
+		},
+	}
+
+	for _, index := range partialIndexes {
+		err := db.Run(bson.D{
+			{Name: "createIndexes", Value: "activities"},
+			{Name: "indexes", Value: []bson.M{index}},
+		}, nil)
+
+		if err != nil {
+			return fmt.Errorf("index %v: %v", index["name"], err)
+		}
+	}
+
+	return nil
+}
+
+//pauseConcurrentRunningActivities migrates data written before only one running activity was allowed.
+//The most recently started activity of profile keeps running, open intervals of others are closed
+func (service *ActivitiesService) pauseConcurrentRunningActivities() error {
 
 	dbStorage := service.storage
 	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"is_started": true}},
+		{"$group": bson.M{"_id": "$profile_id", "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}
+
+	profiles := []struct {
+		ProfileId bson.ObjectId `bson:"_id"`
+	}{}
+
+	if err := activitiesCollection.Pipe(pipeline).AllowDiskUse().All(&profiles); err != nil {
+		return ErrStorageError
+	}
+
+	for _, profile := range profiles {
+		runningActivities := []Activity{}
+		err := activitiesCollection.Find(bson.M{"profile_id": profile.ProfileId, "is_started": true}).All(&runningActivities)
+		if err != nil {
+			return ErrStorageError
+		}
+
+		latest := 0
+		for i := range runningActivities {
+			if runningStart(&runningActivities[i]) > runningStart(&runningActivities[latest]) {
+				latest = i
+			}
+		}
+
+		for i := range runningActivities {
+			if i == latest {
+				continue
+			}
+
+			_, err := service.closeOpenInterval(&runningActivities[i], ActivityPaused)
+			if err != nil && err != ErrIllegalStateTransition {
+				return err
+			}
+		}
+
+		log.Printf("Paused %d concurrently running activities of profile %s", len(runningActivities)-1, profile.ProfileId.Hex())
+	}
+
+	return nil
+}
+
+//runningStart is time when activity was started last time
+func runningStart(a *Activity) int64 {
+
+	if openInterval := a.OpenInterval(); openInterval != nil {
+		return openInterval.Start
+	}
+
+	if a.BeginTime != 0 {
+		return a.BeginTime
+	}
+
+	return a.CreatedAt
+}
+
+//ParseActivityFilter reads filter from listing query parameters.
+//from and to accept unix time in seconds or RFC3339 timestamp
+func ParseActivityFilter(values url.Values) (*ActivityFilter, error) {
+
+	filter := &ActivityFilter{
+		Category: values.Get("category"),
+		Text:     values.Get("q"),
+	}
+
+	var err error
+	if filter.From, err = parseTimeParam(values.Get("from")); err != nil {
+		return nil, ErrBadQueryParams
+	}
+
+	if filter.To, err = parseTimeParam(values.Get("to")); err != nil {
+		return nil, ErrBadQueryParams
+	}
+
+	if filter.From != 0 && filter.To != 0 && filter.From > filter.To {
+		return nil, ErrBadQueryParams
+	}
+
+	if workspaceId := values.Get("workspace_id"); workspaceId != "" {
+		if !bson.IsObjectIdHex(workspaceId) {
+			return nil, ErrBadQueryParams
+		}
+
+		filter.WorkspaceId = workspaceId
+	}
+
+	if isStarted := values.Get("is_started"); isStarted != "" {
+		value, err := strconv.ParseBool(isStarted)
+		if err != nil {
+			return nil, ErrBadQueryParams
+		}
+
+		filter.IsStarted = &value
+	}
+
+	return filter, nil
+}
+
+func parseTimeParam(value string) (int64, error) {
+
+	if value == "" {
+		return 0, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.Unix(), nil
+}
+
+//activitiesQuery builds mongo query for profile activities matching filter
+func activitiesQuery(profileId bson.ObjectId, filter *ActivityFilter) bson.M {
+
 	query := bson.M{
 		"profile_id": bson.M{
-			"$eq": bson.ObjectIdHex(profileId),
+			"$eq": profileId,
 		},
 	}
 
-	profileActivities := []Activity{}
-	err := activitiesCollection.Find(query).All(&profileActivities)
+	if filter == nil {
+		return query
+	}
+
+	if filter.From != 0 || filter.To != 0 {
+		timeRange := bson.M{}
+		if filter.From != 0 {
+			timeRange["$gte"] = filter.From
+		}
+		if filter.To != 0 {
+			timeRange["$lte"] = filter.To
+		}
+
+		overlap := bson.M{}
+		if filter.To != 0 {
+			overlap["begin"] = bson.M{"$lte": filter.To}
+		}
+		if filter.From != 0 {
+			overlap["$or"] = []bson.M{
+				{"end": 0},
+				{"end": bson.M{"$gte": filter.From}},
+			}
+		}
+
+		query["$or"] = []bson.M{
+			{"created_at": timeRange},
+			{"begin_time": timeRange},
+			{"work_intervals": bson.M{"$elemMatch": overlap}},
+		}
+	}
 
+	if filter.WorkspaceId != "" {
+		query["workspace_id"] = bson.ObjectIdHex(filter.WorkspaceId)
+	}
+
+	if filter.Category != "" {
+		query["category"] = filter.Category
+	}
+
+	if filter.IsStarted != nil {
+		if *filter.IsStarted {
+			query["is_started"] = true
+		} else {
+			query["is_started"] = bson.M{"$ne": true}
+		}
+	}
+
+	if filter.Text != "" {
+		query["description"] = bson.RegEx{Pattern: regexp.QuoteMeta(filter.Text), Options: "i"}
+	}
+
+	return query
+}
+
+func (service *ActivitiesService) GetAllActivities(profileId string, filter *ActivityFilter, page *PageRequest) (*ActivityPage, error) {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return nil, ErrBadQueryParams
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+	query := activitiesQuery(bson.ObjectIdHex(profileId), filter)
+
+	total, err := activitiesCollection.Find(query).Count()
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	cursorQuery, err := page.cursorQuery()
 	if err != nil {
+		return nil, err
+	}
+
+	pageQuery := query
+	if cursorQuery != nil {
+		pageQuery = bson.M{"$and": []bson.M{query, cursorQuery}}
+	}
+
+	result := &ActivityPage{Items: []Activity{}, Total: total}
+	iter := activitiesCollection.Find(pageQuery).Sort(page.sortOrder()...).Limit(page.Limit + 1).Iter()
+
+	var raw bson.Raw
+	var lastKeys sortKeys
+	for iter.Next(&raw) {
+		if len(result.Items) == page.Limit {
+			last := result.Items[len(result.Items)-1]
+			result.NextCursor = page.encodeCursor(lastKeys.value(page.SortField), last.Id)
+			break
+		}
+
+		activity := Activity{}
+		lastKeys = sortKeys{}
+		if err := raw.Unmarshal(&activity); err != nil {
+			iter.Close()
+			return nil, ErrStorageError
+		}
+
+		if err := raw.Unmarshal(&lastKeys); err != nil {
+			iter.Close()
+			return nil, ErrStorageError
+		}
+
+		result.Items = append(result.Items, activity)
+	}
+
+	if err := iter.Close(); err != nil {
 		return nil, ErrStorageError
 	}
 
-	return &profileActivities, nil
+	return result, nil
+}
+
+//ExportWorkIntervals passes work intervals of filtered activities to handle one by one
+//straight from mongo cursor. With time range only overlapping intervals are exported
+func (service *ActivitiesService) ExportWorkIntervals(profileId string, filter *ActivityFilter, handle func(*ExportedInterval) error) error {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrBadQueryParams
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+
+	pipeline := []bson.M{
+		{"$match": activitiesQuery(bson.ObjectIdHex(profileId), filter)},
+		{"$sort": bson.M{"created_at": 1, "_id": 1}},
+		{"$unwind": "$work_intervals"},
+	}
+
+	if filter != nil && (filter.From != 0 || filter.To != 0) {
+		overlap := bson.M{}
+		if filter.To != 0 {
+			overlap["work_intervals.begin"] = bson.M{"$lte": filter.To}
+		}
+		if filter.From != 0 {
+			overlap["$or"] = []bson.M{
+				{"work_intervals.end": 0},
+				{"work_intervals.end": bson.M{"$gte": filter.From}},
+			}
+		}
+
+		pipeline = append(pipeline, bson.M{"$match": overlap})
+	}
+
+	pipeline = append(pipeline, bson.M{"$project": bson.M{
+		"_id":            0,
+		"description":    1,
+		"category":       1,
+		"work_intervals": 1,
+	}})
+
+	iter := activitiesCollection.Pipe(pipeline).AllowDiskUse().Iter()
+
+	interval := ExportedInterval{}
+	for iter.Next(&interval) {
+		if err := handle(&interval); err != nil {
+			iter.Close()
+			return err
+		}
+
+		interval = ExportedInterval{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//ImportActivities stores each valid row as stopped activity with single work interval.
+//Rows are matched by external id, so already imported rows are only counted as duplicates
+func (service *ActivitiesService) ImportActivities(profileId string, rows []ImportRow, dryRun bool) (*ImportResult, error) {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return nil, ErrBadQueryParams
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+
+	result := &ImportResult{DryRun: dryRun, Total: len(rows), Errors: []ImportRowError{}}
+	owner := bson.ObjectIdHex(profileId)
+
+	validRows := []ImportRow{}
+	externalIds := []string{}
+	seen := map[string]bool{}
+	for _, row := range rows {
+		if row.Err != nil {
+			result.Errors = append(result.Errors, ImportRowError{Row: row.Row, Error: row.Err.Error()})
+			continue
+		}
+
+		if seen[row.ExternalId] {
+			result.Duplicates++
+			continue
+		}
+
+		seen[row.ExternalId] = true
+		validRows = append(validRows, row)
+		externalIds = append(externalIds, row.ExternalId)
+	}
+
+	if dryRun {
+		existing, err := activitiesCollection.Find(bson.M{
+			"profile_id":  owner,
+			"external_id": bson.M{"$in": externalIds},
+		}).Count()
+
+		if err != nil {
+			return nil, ErrStorageError
+		}
+
+		result.Duplicates += existing
+		result.Imported = len(validRows) - existing
+		return result, nil
+	}
+
+	for _, row := range validRows {
+		importedActivity := &Activity{
+			Id:             bson.NewObjectId(),
+			ProfileId:      owner,
+			Status:         ActivityStopped,
+			Description:    row.Description,
+			Category:       row.Category,
+			CreatedAt:      row.Start,
+			BeginTime:      row.Start,
+			ActualDuration: uint64(row.End - row.Start),
+			WorkIntervals:  []WorkInterval{{Start: row.Start, Stop: row.End}},
+			ExternalId:     row.ExternalId,
+		}
+
+		changeInfo, err := activitiesCollection.Upsert(
+			bson.M{"profile_id": owner, "external_id": row.ExternalId},
+			bson.M{"$setOnInsert": importedActivity},
+		)
+
+		if err != nil {
+			return nil, ErrStorageError
+		}
+
+		if changeInfo.UpsertedId != nil {
+			result.Imported++
+		} else {
+			result.Duplicates++
+		}
+	}
+
+	return result, nil
 }
 
-func (service *ActivitiesService) CreateActivity(a *Activity) (*Activity, error) {
+//maxStartAttempts limits retries when activity of profile is started concurrently from other device
+const maxStartAttempts = 3
+
+//errRunningActivityConflict is returned by applyTransition when other activity of profile is running
+var errRunningActivityConflict = errors.New("Other activity of profile is running")
+
+//isRunningActivityConflict tells that write failed because profile already has running activity
+func isRunningActivityConflict(err error) bool {
+	return mgo.IsDup(err) && strings.Contains(err.Error(), runningActivityIndex)
+}
+
+//CreateActivity stores new activity of profile, profile id of passed activity is ignored
+func (service *ActivitiesService) CreateActivity(profileId string, a *Activity) (*Activity, error) {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return nil, ErrBadQueryParams
+	}
 
 	dbStorage := service.storage
 	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
 
+	now := time.Now().Unix()
 	storeActivity := &Activity{
 		Id:               bson.NewObjectId(),
-		ProfileId:        a.ProfileId,
+		ProfileId:        bson.ObjectIdHex(profileId),
 		IsStarted:        a.IsStarted,
 		Description:      a.Description,
 		Category:         a.Category,
-		CreatedAt:        time.Now().Unix(),
+		CreatedAt:        now,
 		WorkIntervals:    a.WorkIntervals,
 		PlannedBeginTime: a.PlannedBeginTime,
 		ActualDuration:   a.ActualDuration,
 		BeginTime:        a.BeginTime,
+		WorkspaceId:      a.WorkspaceId,
 	}
 
+	if storeActivity.IsStarted {
+		if storeActivity.OpenInterval() == nil {
+			storeActivity.WorkIntervals = append(storeActivity.WorkIntervals, WorkInterval{Start: now})
+		}
+
+		if storeActivity.BeginTime == 0 {
+			storeActivity.BeginTime = now
+		}
+	}
+
+	storeActivity.Status = storeActivity.CurrentStatus()
+
+	//running activity of profile is paused only when it blocks insert, so failed create leaves it running
 	err := activitiesCollection.Insert(&storeActivity)
+	for attempt := 0; attempt < maxStartAttempts && storeActivity.IsStarted && isRunningActivityConflict(err); attempt++ {
+		if err := service.pauseRunningActivities(storeActivity.ProfileId, storeActivity.Id); err != nil {
+			return nil, err
+		}
+
+		err = activitiesCollection.Insert(&storeActivity)
+	}
+
+	if mgo.IsDup(err) {
+		return nil, ErrIllegalStateTransition
+	}
 
 	if err != nil {
 		return nil, ErrStorageError
@@ -57,7 +533,40 @@ func (service *ActivitiesService) CreateActivity(a *Activity) (*Activity, error)
 	return storeActivity, nil
 }
 
-func (service *ActivitiesService) GetActivity(activityId string) (*Activity, error) {
+//GetCurrentActivity returns running activity of profile
+func (service *ActivitiesService) GetCurrentActivity(profileId string) (*Activity, error) {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return nil, ErrNotExists
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+	query := bson.M{
+		"profile_id": bson.ObjectIdHex(profileId),
+		"is_started": true,
+	}
+
+	runningActivity := Activity{}
+	err := activitiesCollection.Find(query).One(&runningActivity)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotExists
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return &runningActivity, nil
+}
+
+//GetActivity returns activity of profile, activities of other profiles don't exist for caller
+func (service *ActivitiesService) GetActivity(profileId string, activityId string) (*Activity, error) {
+
+	if !bson.IsObjectIdHex(profileId) || !bson.IsObjectIdHex(activityId) {
+		return nil, ErrNotExists
+	}
 
 	dbStorage := service.storage
 	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
@@ -65,11 +574,16 @@ func (service *ActivitiesService) GetActivity(activityId string) (*Activity, err
 		"_id": bson.M{
 			"$eq": bson.ObjectIdHex(activityId),
 		},
+		"profile_id": bson.ObjectIdHex(profileId),
 	}
 
 	storedActivity := Activity{}
 	err := activitiesCollection.Find(query).One(&storedActivity)
 
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotExists
+	}
+
 	if err != nil {
 		return nil, ErrStorageError
 	}
@@ -77,20 +591,61 @@ func (service *ActivitiesService) GetActivity(activityId string) (*Activity, err
 	return &storedActivity, nil
 }
 
-func (service *ActivitiesService) UpdateActivity(a *Activity) error {
+//UpdateActivity changes details of activity. Timer state, work intervals and tracked duration
+//are changed only by start, pause, resume and stop, so they are ignored here
+func (service *ActivitiesService) UpdateActivity(profileId string, a *Activity) error {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrNotExists
+	}
 
 	dbStorage := service.storage
 	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
 
-	err := activitiesCollection.Update(bson.M{"_id": a.Id}, bson.M{"$set": bson.M{
+	update := bson.M{"$set": bson.M{
 		"description":        a.Description,
-		"is_started":         a.IsStarted,
 		"category":           a.Category,
 		"begin_time":         a.BeginTime,
 		"planned_begin_time": a.PlannedBeginTime,
-		"actual_duration":    a.ActualDuration,
-		"work_intervals":     a.WorkIntervals,
-	}})
+	}}
+
+	//clients not aware of workspaces omit workspace_id, activity stays shared then. It's unshared by UnshareActivity
+	if a.WorkspaceId != "" {
+		update["$set"].(bson.M)["workspace_id"] = a.WorkspaceId
+	}
+
+	err := activitiesCollection.Update(bson.M{"_id": a.Id, "profile_id": bson.ObjectIdHex(profileId)}, update)
+
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//UnshareActivity removes activity from workspace it was shared with
+func (service *ActivitiesService) UnshareActivity(profileId string, activityId string) error {
+
+	if !bson.IsObjectIdHex(profileId) || !bson.IsObjectIdHex(activityId) {
+		return ErrNotExists
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+	query := bson.M{
+		"_id":        bson.ObjectIdHex(activityId),
+		"profile_id": bson.ObjectIdHex(profileId),
+	}
+
+	err := activitiesCollection.Update(query, bson.M{"$unset": bson.M{"workspace_id": ""}})
+
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
 
 	if err != nil {
 		return ErrStorageError
@@ -99,7 +654,11 @@ func (service *ActivitiesService) UpdateActivity(a *Activity) error {
 	return nil
 }
 
-func (service *ActivitiesService) DeleteActivity(activityId string) error {
+func (service *ActivitiesService) DeleteActivity(profileId string, activityId string) error {
+
+	if !bson.IsObjectIdHex(profileId) || !bson.IsObjectIdHex(activityId) {
+		return ErrNotExists
+	}
 
 	dbStorage := service.storage
 	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
@@ -107,13 +666,203 @@ func (service *ActivitiesService) DeleteActivity(activityId string) error {
 		"_id": bson.M{
 			"$eq": bson.ObjectIdHex(activityId),
 		},
+		"profile_id": bson.ObjectIdHex(profileId),
 	}
 
 	err := activitiesCollection.Remove(query)
 
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
 	if err != nil {
 		return ErrStorageError
 	}
 
 	return nil
 }
+
+func (service *ActivitiesService) StartActivity(profileId string, activityId string) (*Activity, error) {
+
+	storedActivity, err := service.GetActivity(profileId, activityId)
+	if err != nil {
+		return nil, err
+	}
+
+	if storedActivity.CurrentStatus() != ActivityCreated {
+		return nil, ErrIllegalStateTransition
+	}
+
+	now := time.Now().Unix()
+	set := bson.M{"status": ActivityRunning, "is_started": true}
+	if storedActivity.BeginTime == 0 {
+		set["begin_time"] = now
+	}
+
+	return service.runTransition(storedActivity, bson.M{
+		"$set":  set,
+		"$push": bson.M{"work_intervals": WorkInterval{Start: now}},
+	})
+}
+
+func (service *ActivitiesService) PauseActivity(profileId string, activityId string) (*Activity, error) {
+
+	storedActivity, err := service.GetActivity(profileId, activityId)
+	if err != nil {
+		return nil, err
+	}
+
+	if storedActivity.CurrentStatus() != ActivityRunning {
+		return nil, ErrIllegalStateTransition
+	}
+
+	return service.closeOpenInterval(storedActivity, ActivityPaused)
+}
+
+func (service *ActivitiesService) ResumeActivity(profileId string, activityId string) (*Activity, error) {
+
+	storedActivity, err := service.GetActivity(profileId, activityId)
+	if err != nil {
+		return nil, err
+	}
+
+	if storedActivity.CurrentStatus() != ActivityPaused {
+		return nil, ErrIllegalStateTransition
+	}
+
+	return service.runTransition(storedActivity, bson.M{
+		"$set":  bson.M{"status": ActivityRunning, "is_started": true},
+		"$push": bson.M{"work_intervals": WorkInterval{Start: time.Now().Unix()}},
+	})
+}
+
+func (service *ActivitiesService) StopActivity(profileId string, activityId string) (*Activity, error) {
+
+	storedActivity, err := service.GetActivity(profileId, activityId)
+	if err != nil {
+		return nil, err
+	}
+
+	switch storedActivity.CurrentStatus() {
+	case ActivityRunning:
+		return service.closeOpenInterval(storedActivity, ActivityStopped)
+	case ActivityPaused:
+		return service.applyTransition(storedActivity, nil, bson.M{
+			"$set": bson.M{"status": ActivityStopped, "is_started": false},
+		})
+	default:
+		return nil, ErrIllegalStateTransition
+	}
+}
+
+//runTransition makes activity running. Other running activity of profile is paused
+//only when it blocks transition, so failed start or resume leaves it running
+func (service *ActivitiesService) runTransition(a *Activity, update bson.M) (*Activity, error) {
+
+	updatedActivity, err := service.applyTransition(a, nil, update)
+	for attempt := 0; attempt < maxStartAttempts && err == errRunningActivityConflict; attempt++ {
+		if err := service.pauseRunningActivities(a.ProfileId, a.Id); err != nil {
+			return nil, err
+		}
+
+		updatedActivity, err = service.applyTransition(a, nil, update)
+	}
+
+	if err == errRunningActivityConflict {
+		return nil, ErrIllegalStateTransition
+	}
+
+	return updatedActivity, err
+}
+
+//pauseRunningActivities closes open intervals of other running activities of profile
+func (service *ActivitiesService) pauseRunningActivities(profileId bson.ObjectId, exceptId bson.ObjectId) error {
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+	query := bson.M{
+		"profile_id": profileId,
+		"is_started": true,
+		"_id": bson.M{
+			"$ne": exceptId,
+		},
+	}
+
+	runningActivities := []Activity{}
+	if err := activitiesCollection.Find(query).All(&runningActivities); err != nil {
+		return ErrStorageError
+	}
+
+	for i := range runningActivities {
+		_, err := service.closeOpenInterval(&runningActivities[i], ActivityPaused)
+		if err != nil && err != ErrIllegalStateTransition {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//closeOpenInterval finishes running interval by server clock and adds its length to actual duration
+func (service *ActivitiesService) closeOpenInterval(a *Activity, status string) (*Activity, error) {
+
+	openInterval := a.OpenInterval()
+	if openInterval == nil {
+		return service.applyTransition(a, nil, bson.M{
+			"$set": bson.M{"status": status, "is_started": false},
+		})
+	}
+
+	now := time.Now().Unix()
+	duration := now - openInterval.Start
+	if duration < 0 {
+		duration = 0
+	}
+
+	selector := bson.M{
+		"work_intervals": bson.M{
+			"$elemMatch": bson.M{"begin": openInterval.Start, "end": 0},
+		},
+	}
+
+	return service.applyTransition(a, selector, bson.M{
+		"$set": bson.M{"work_intervals.$.end": now, "status": status, "is_started": false},
+		"$inc": bson.M{"actual_duration": duration},
+	})
+}
+
+//applyTransition updates activity only if it still has the state it was read with,
+//so concurrent transitions from several devices can't overwrite each other
+func (service *ActivitiesService) applyTransition(a *Activity, selector bson.M, update bson.M) (*Activity, error) {
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+
+	query := bson.M{"_id": a.Id}
+	if a.Status != "" {
+		query["status"] = a.Status
+	} else {
+		query["status"] = bson.M{"$exists": false}
+	}
+
+	for k, v := range selector {
+		query[k] = v
+	}
+
+	updatedActivity := Activity{}
+	_, err := activitiesCollection.Find(query).Apply(mgo.Change{Update: update, ReturnNew: true}, &updatedActivity)
+
+	if isRunningActivityConflict(err) {
+		return nil, errRunningActivityConflict
+	}
+
+	if err == mgo.ErrNotFound || mgo.IsDup(err) {
+		return nil, ErrIllegalStateTransition
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return &updatedActivity, nil
+}
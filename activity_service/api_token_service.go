@@ -0,0 +1,162 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//apiTokenPrefix tells personal api tokens from session jwt and makes leaked tokens easy to find by scanners
+const apiTokenPrefix = "ttp_"
+
+//apiTokenPrefixLength is part of token kept in plain to recognize it in tokens list
+const apiTokenPrefixLength = len(apiTokenPrefix) + 6
+
+const maxApiTokensPerProfile = 50
+
+//apiTokenScopes can be granted to personal api tokens. Account management is left to interactive sessions
+var apiTokenScopes = []string{ScopeActivitiesRead, ScopeActivitiesWrite, ScopeReportsRead}
+
+//ApiTokenService manages long-lived personal tokens for scripts and integrations.
+//Only hash of token is stored, token itself is returned once on creation
+type ApiTokenService struct {
+	storage *MongoDbStorage
+}
+
+func (service *ApiTokenService) tokens() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("api_tokens")
+}
+
+func (service *ApiTokenService) EnsureIndexes() error {
+
+	if err := service.tokens().EnsureIndex(mgo.Index{Key: []string{"token_hash"}, Unique: true, Background: true}); err != nil {
+		return err
+	}
+
+	return service.tokens().EnsureIndex(mgo.Index{Key: []string{"profile_id"}, Background: true})
+}
+
+func validApiTokenScope(scope string) bool {
+
+	for _, s := range apiTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (service *ApiTokenService) CreateApiToken(profileId bson.ObjectId, request *ApiTokenRequest) (*CreatedApiToken, error) {
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Scopes) == 0 || request.ExpiresInDays < 0 {
+		return nil, ErrBadHttpRequestBody
+	}
+
+	for _, scope := range request.Scopes {
+		if !validApiTokenScope(scope) {
+			return nil, ErrBadScope
+		}
+	}
+
+	tokensCollection := service.tokens()
+	count, err := tokensCollection.Find(bson.M{"profile_id": profileId}).Count()
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if count >= maxApiTokensPerProfile {
+		return nil, ErrTooManyApiTokens
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	token := apiTokenPrefix + secret
+	now := time.Now()
+
+	storeToken := ApiToken{
+		Id:        bson.NewObjectId(),
+		ProfileId: profileId,
+		Name:      request.Name,
+		Prefix:    token[:apiTokenPrefixLength],
+		TokenHash: hashToken(token),
+		Scopes:    request.Scopes,
+		CreatedAt: now.Unix(),
+	}
+
+	if request.ExpiresInDays > 0 {
+		storeToken.ExpiresAt = now.AddDate(0, 0, request.ExpiresInDays).Unix()
+	}
+
+	if err := tokensCollection.Insert(&storeToken); err != nil {
+		return nil, ErrStorageError
+	}
+
+	return &CreatedApiToken{ApiToken: storeToken, Token: token}, nil
+}
+
+func (service *ApiTokenService) ListApiTokens(profileId bson.ObjectId) ([]ApiToken, error) {
+
+	apiTokens := []ApiToken{}
+	if err := service.tokens().Find(bson.M{"profile_id": profileId}).Sort("-created_at").All(&apiTokens); err != nil {
+		return nil, ErrStorageError
+	}
+
+	return apiTokens, nil
+}
+
+func (service *ApiTokenService) RevokeApiToken(profileId bson.ObjectId, tokenId string) error {
+
+	if !bson.IsObjectIdHex(tokenId) {
+		return ErrNotExists
+	}
+
+	err := service.tokens().Remove(bson.M{"_id": bson.ObjectIdHex(tokenId), "profile_id": profileId})
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//AuthByApiToken returns not expired token, last usage time is updated not more often than for sessions
+func (service *ApiTokenService) AuthByApiToken(token string) (*ApiToken, error) {
+
+	now := time.Now()
+	tokensCollection := service.tokens()
+
+	apiToken := ApiToken{}
+	err := tokensCollection.Find(bson.M{
+		"token_hash": hashToken(token),
+		"$or": []bson.M{
+			{"expires_at": bson.M{"$exists": false}},
+			{"expires_at": bson.M{"$gt": now.Unix()}},
+		},
+	}).One(&apiToken)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrUnauthoriazedAccess
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if now.Unix()-apiToken.LastUsedAt >= int64(lastSeenInterval/time.Second) {
+		apiToken.LastUsedAt = now.Unix()
+		tokensCollection.UpdateId(apiToken.Id, bson.M{"$set": bson.M{"last_used_at": apiToken.LastUsedAt}})
+	}
+
+	return &apiToken, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//scopes of protected routes
+const (
+	ScopeAccount         = "account"
+	ScopeActivitiesRead  = "activities:read"
+	ScopeActivitiesWrite = "activities:write"
+	ScopeReportsRead     = "reports:read"
+)
+
+//sessionScopes are granted to interactive sessions, they allow everything
+var sessionScopes = []string{ScopeAccount, ScopeActivitiesRead, ScopeActivitiesWrite, ScopeReportsRead}
+
+//AuthContext describes caller of protected route, it is mapped by Authenticate.
+//SessionId is empty when caller is authenticated by api token
+type AuthContext struct {
+	ProfileId  bson.ObjectId
+	SessionId  string
+	ApiTokenId string
+	Scopes     []string
+}
+
+func (auth *AuthContext) HasScope(scope string) bool {
+
+	for _, s := range auth.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+//OwnProfile returns caller profile id when requested one is empty or the same.
+//Resources of other profiles are not accessible
+func (auth *AuthContext) OwnProfile(requestedId string) (string, error) {
+
+	if requestedId != "" && requestedId != auth.ProfileId.Hex() {
+		return "", ErrForbidden
+	}
+
+	return auth.ProfileId.Hex(), nil
+}
+
+//unauthorized is the only response of failed authentication
+func unauthorized(rnd render.Render, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+}
+
+//Authenticate resolves session jwt or personal api token and maps AuthContext for next handlers.
+//Request without valid token is answered with 401 and doesn't reach route handler
+func Authenticate(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter, c martini.Context) {
+
+	profileService := provider.GetProfileService()
+	tokenString, err := profileService.ExtractTokenFromRequest(r)
+	if err != nil {
+		unauthorized(rnd, w)
+		return
+	}
+
+	if strings.HasPrefix(tokenString, apiTokenPrefix) {
+		apiToken, err := provider.GetApiTokenService().AuthByApiToken(tokenString)
+		if err == ErrStorageError {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		if err != nil {
+			unauthorized(rnd, w)
+			return
+		}
+
+		c.Map(&AuthContext{ProfileId: apiToken.ProfileId, ApiTokenId: apiToken.Id.Hex(), Scopes: apiToken.Scopes})
+		return
+	}
+
+	session, err := provider.GetSessionService().AuthBySessionToken(tokenString)
+	if err == ErrStorageError {
+		rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		return
+	}
+
+	if err != nil {
+		unauthorized(rnd, w)
+		return
+	}
+
+	c.Map(&AuthContext{ProfileId: session.ProfileId, SessionId: session.Id.Hex(), Scopes: sessionScopes})
+}
+
+//RequireScope makes handler which answers 403 when caller wasn't granted scope
+func RequireScope(scope string) martini.Handler {
+
+	return func(auth *AuthContext, rnd render.Render) {
+		if !auth.HasScope(scope) {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{ErrForbidden.Error()})
+		}
+	}
+}
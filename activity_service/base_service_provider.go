@@ -4,4 +4,12 @@ type BaseServiceProvider interface {
 	GetProfileService() *ProfileService
 	GetActivityService() *ActivitiesService
 	GetSettingsService() *SettingsService
+	GetReportsService() *ReportsService
+	GetCalendarService() *CalendarService
+	GetSessionService() *SessionService
+	GetTwoFactorService() *TwoFactorService
+	GetLoginGuardService() *LoginGuardService
+	GetOidcService() *OidcService
+	GetApiTokenService() *ApiTokenService
+	GetWorkspaceService() *WorkspaceService
 }
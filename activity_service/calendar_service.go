@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//calendarFeedHistory limits how old work intervals are put into feed
+const calendarFeedHistory = 90 * 24 * time.Hour
+
+//plannedEventDuration is length of planned activity in calendar, activities have no planned length
+const plannedEventDuration = time.Hour
+
+type CalendarService struct {
+	storage *MongoDbStorage
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+//CreateCalendarToken issues new feed token for profile, previous token stops working.
+//Only hash of token is stored, so token is returned to caller once
+func (service *CalendarService) CreateCalendarToken(profileId string) (string, error) {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return "", ErrNotExists
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	dbStorage := service.storage
+	tokensCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("calendar_tokens")
+
+	_, err = tokensCollection.Upsert(bson.M{"profile_id": bson.ObjectIdHex(profileId)}, bson.M{"$set": bson.M{
+		"token_hash": hashToken(token),
+		"created_at": time.Now().Unix(),
+	}})
+
+	if err != nil {
+		return "", ErrStorageError
+	}
+
+	return token, nil
+}
+
+func (service *CalendarService) RevokeCalendarToken(profileId string) error {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrNotExists
+	}
+
+	dbStorage := service.storage
+	tokensCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("calendar_tokens")
+
+	err := tokensCollection.Remove(bson.M{"profile_id": bson.ObjectIdHex(profileId)})
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+func (service *CalendarService) AuthByCalendarToken(profileId string, token string) error {
+
+	if !bson.IsObjectIdHex(profileId) || token == "" {
+		return ErrUnauthoriazedAccess
+	}
+
+	dbStorage := service.storage
+	tokensCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("calendar_tokens")
+
+	storedToken := CalendarToken{}
+	err := tokensCollection.Find(bson.M{"profile_id": bson.ObjectIdHex(profileId)}).One(&storedToken)
+	if err == mgo.ErrNotFound {
+		return ErrUnauthoriazedAccess
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	if subtle.ConstantTimeCompare([]byte(storedToken.TokenHash), []byte(hashToken(token))) != 1 {
+		return ErrUnauthoriazedAccess
+	}
+
+	return nil
+}
+
+//WriteCalendar writes iCalendar feed with planned activities as free events
+//and work intervals of recent activities as busy events
+func (service *CalendarService) WriteCalendar(profileId string, w io.Writer) error {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrNotExists
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+
+	now := time.Now()
+	since := now.Add(-calendarFeedHistory).Unix()
+	query := bson.M{
+		"profile_id": bson.ObjectIdHex(profileId),
+		"$or": []bson.M{
+			{"planned_begin_time": bson.M{"$gte": since}},
+			{"work_intervals.end": bson.M{"$gte": since}},
+		},
+	}
+
+	cw := &calendarWriter{w: w, stamp: formatCalendarTime(now.Unix())}
+	cw.line("BEGIN:VCALENDAR")
+	cw.line("VERSION:2.0")
+	cw.line("PRODID:-//TimeTrackerService//Activities//EN")
+	cw.line("CALSCALE:GREGORIAN")
+	cw.line("X-WR-CALNAME:Time tracker")
+
+	iter := activitiesCollection.Find(query).Sort("created_at").Iter()
+
+	activity := Activity{}
+	for iter.Next(&activity) {
+		summary := activity.Description
+		if summary == "" {
+			summary = activity.Category
+		}
+
+		if activity.PlannedBeginTime >= since {
+			cw.event(fmt.Sprintf("%s-planned", activity.Id.Hex()), summary, activity.Category, activity.PlannedBeginTime, 0, false)
+		}
+
+		for _, interval := range activity.WorkIntervals {
+			if interval.Stop == 0 || interval.Stop < since {
+				continue
+			}
+
+			cw.event(fmt.Sprintf("%s-%d", activity.Id.Hex(), interval.Start), summary, activity.Category, interval.Start, interval.Stop, true)
+		}
+
+		activity = Activity{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return ErrStorageError
+	}
+
+	cw.line("END:VCALENDAR")
+	return cw.err
+}
+
+type calendarWriter struct {
+	w     io.Writer
+	stamp string
+	err   error
+}
+
+func (cw *calendarWriter) event(uid string, summary string, category string, start int64, end int64, busy bool) {
+
+	cw.line("BEGIN:VEVENT")
+	cw.line("UID:" + uid + "@timetracker")
+	cw.line("DTSTAMP:" + cw.stamp)
+	cw.line("DTSTART:" + formatCalendarTime(start))
+	if end != 0 {
+		cw.line("DTEND:" + formatCalendarTime(end))
+	} else {
+		cw.line(fmt.Sprintf("DURATION:PT%dM", int64(plannedEventDuration/time.Minute)))
+	}
+
+	cw.line("SUMMARY:" + escapeCalendarText(summary))
+	if category != "" {
+		cw.line("CATEGORIES:" + escapeCalendarText(category))
+	}
+
+	if busy {
+		cw.line("TRANSP:OPAQUE")
+	} else {
+		cw.line("TRANSP:TRANSPARENT")
+	}
+
+	cw.line("END:VEVENT")
+}
+
+//line writes content line folded by 75 octets as RFC 5545 requires
+func (cw *calendarWriter) line(content string) {
+
+	if cw.err != nil {
+		return
+	}
+
+	var b strings.Builder
+	width := 0
+	for _, r := range content {
+		size := len(string(r))
+		if width+size > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+
+		b.WriteRune(r)
+		width += size
+	}
+
+	b.WriteString("\r\n")
+	_, cw.err = io.WriteString(cw.w, b.String())
+}
+
+func formatCalendarTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format("20060102T150405Z")
+}
+
+func escapeCalendarText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\r", `\n`, "\n", `\n`).Replace(text)
+}
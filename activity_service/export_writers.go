@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	ExportFormatCsv  = "csv"
+	ExportFormatXlsx = "xlsx"
+)
+
+//RowWriter writes export rows one by one directly to output,
+//so export doesn't keep whole table in memory
+type RowWriter interface {
+	WriteRow(values []interface{}) error
+	Close() error
+}
+
+func NewRowWriter(format string, w io.Writer) (RowWriter, error) {
+	switch format {
+	case ExportFormatCsv:
+		return &csvRowWriter{w: csv.NewWriter(w)}, nil
+	case ExportFormatXlsx:
+		return newXlsxRowWriter(w)
+	default:
+		return nil, ErrBadQueryParams
+	}
+}
+
+func ExportContentType(format string) string {
+	if format == ExportFormatXlsx {
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+
+	return "text/csv; charset=utf-8"
+}
+
+//spreadsheetText prefixes csv text which spreadsheet applications would evaluate as formula,
+//so descriptions entered by users can't run in workbook of whoever opens export.
+//Inline strings of xlsx are never evaluated, they are written as is
+func spreadsheetText(text string) string {
+
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+
+	return text
+}
+
+type csvRowWriter struct {
+	w    *csv.Writer
+	rows int
+}
+
+func (cw *csvRowWriter) WriteRow(values []interface{}) error {
+
+	record := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case int64, float64:
+			record[i] = fmt.Sprint(v)
+		default:
+			record[i] = spreadsheetText(fmt.Sprint(v))
+		}
+	}
+
+	if err := cw.w.Write(record); err != nil {
+		return err
+	}
+
+	cw.rows++
+	if cw.rows%500 == 0 {
+		cw.w.Flush()
+		return cw.w.Error()
+	}
+
+	return nil
+}
+
+func (cw *csvRowWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+//xlsxRowWriter produces minimal single sheet workbook. Strings are
+//written as inline strings, so no shared strings table has to be collected
+type xlsxRowWriter struct {
+	archive *zip.Writer
+	sheet   io.Writer
+	rows    int
+}
+
+const xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`
+
+const xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`
+
+const xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Activities" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`
+
+const xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`
+
+func newXlsxRowWriter(w io.Writer) (*xlsxRowWriter, error) {
+
+	archive := zip.NewWriter(w)
+	parts := []struct {
+		name    string
+		content string
+	}{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+
+	for _, part := range parts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`+
+		`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &xlsxRowWriter{archive: archive, sheet: sheet}, nil
+}
+
+func (xw *xlsxRowWriter) WriteRow(values []interface{}) error {
+
+	xw.rows++
+	if _, err := fmt.Fprintf(xw.sheet, `<row r="%d">`, xw.rows); err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		var err error
+		switch v := value.(type) {
+		case int64:
+			_, err = fmt.Fprintf(xw.sheet, `<c><v>%d</v></c>`, v)
+		case float64:
+			_, err = fmt.Fprintf(xw.sheet, `<c><v>%s</v></c>`, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			if _, err = io.WriteString(xw.sheet, `<c t="inlineStr"><is><t xml:space="preserve">`); err != nil {
+				return err
+			}
+
+			if err = xml.EscapeText(xw.sheet, []byte(fmt.Sprint(v))); err != nil {
+				return err
+			}
+
+			_, err = io.WriteString(xw.sheet, `</t></is></c>`)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(xw.sheet, `</row>`)
+	return err
+}
+
+func (xw *xlsxRowWriter) Close() error {
+
+	if _, err := io.WriteString(xw.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+
+	return xw.archive.Close()
+}
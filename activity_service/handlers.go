@@ -2,19 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	pb "github.com/RustamSafiulin/TimeTrackerService/mail_service/api"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
-	"google.golang.org/grpc"
+	"gopkg.in/mgo.v2/bson"
 )
 
-func InitializeApi(config *Config) *martini.ClassicMartini {
+func InitializeApi(config *Config, storage *MongoDbStorage, keys *JwtKeySet, mailClient pb.MailServiceClient) *martini.ClassicMartini {
 
 	api := martini.Classic()
 	api.Use(render.Renderer(render.Options{
@@ -22,19 +27,47 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 		IndentJSON: true,
 		Directory:  "../public/static/views",
 		Extensions: []string{".html"},
-		Delims:     render.Delims{"{[{", "}]}"},
+		Delims:     render.Delims{Left: "{[{", Right: "}]}"},
 	}))
 
-	grpcConn, err := grpc.Dial("mail_service_container:3001", grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("grpc dial failed: %v", err)
-		return nil
+	provider := NewServiceProvider(config, storage, keys)
+
+	//activities indexes keep single running activity and idempotent import, service can't work without them
+	if err := provider.GetActivityService().EnsureIndexes(); err != nil {
+		log.Fatalf("Failed to create activities indexes: %v", err)
+	}
+
+	if err := provider.GetProfileService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create profiles indexes: %v", err)
+	}
+
+	if err := provider.GetSessionService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create sessions indexes: %v", err)
+	}
+
+	if err := provider.GetTwoFactorService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create two-factor indexes: %v", err)
+	}
+
+	if err := provider.GetLoginGuardService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create login attempts indexes: %v", err)
+	}
+
+	if err := provider.GetOidcService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create oidc indexes: %v", err)
+	}
+
+	if err := provider.GetApiTokenService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create api tokens indexes: %v", err)
 	}
 
-	mailClient := pb.NewMailServiceClient(grpcConn)
+	if err := provider.GetWorkspaceService().EnsureIndexes(); err != nil {
+		log.Printf("Failed to create workspaces indexes: %v", err)
+	}
 
-	storage := NewMongoStorage(config.MongoUrl, config.DbName)
-	provider := NewServiceProvider(storage)
+	if err := provider.GetProfileService().MarkLegacyProfilesVerified(); err != nil {
+		log.Printf("Failed to mark existing profiles verified: %v", err)
+	}
 
 	var baseProvider BaseServiceProvider
 	baseProvider = provider
@@ -42,8 +75,8 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 	api.MapTo(baseProvider, (*BaseServiceProvider)(nil))
 	api.MapTo(mailClient, (*pb.MailServiceClient)(nil))
 
-	api.Post("/api/v1/signin", func(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
-		var loginInfo Profile
+	api.Post("/api/v1/signin", func(mailClient pb.MailServiceClient, provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+		var loginInfo SignInRequest
 
 		err := json.NewDecoder(r.Body).Decode(&loginInfo)
 		if err != nil {
@@ -51,438 +84,1306 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 			return
 		}
 
-		profileService := provider.GetProfileService()
-		sessionInfo, err := profileService.Login(&loginInfo)
+		client := ClientInfoFromRequest(config, r, loginInfo.Device)
+		loginGuard := provider.GetLoginGuardService()
 
+		//attempt is counted before password is checked, so parallel requests can't bypass delay
+		retryAfter, accountLocked, err := loginGuard.Reserve(loginInfo.Email, client.Ip)
 		switch err {
-		case ErrProfileDoesntExist:
-		case ErrWrongPassword:
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
+		case ErrTooManyAttempts:
+			tooManyAttempts(rnd, w, retryAfter, err)
 			return
-		case ErrStorageError:
+		case nil:
+		default:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
-		case nil:
-			rnd.JSON(http.StatusOK, sessionInfo)
+		}
+
+		profileService := provider.GetProfileService()
+		profile, err := profileService.CheckCredentials(&Profile{Email: loginInfo.Email, Password: loginInfo.Password})
+
+		switch err {
+		case ErrProfileDoesntExist, ErrWrongPassword:
+			//the same answer for unknown email and wrong password, so registered emails can't be enumerated
+			if accountLocked {
+				notifyAccountLocked(config, provider, mailClient, loginInfo.Email, client.Ip)
+			}
+
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrInvalidCredentials.Error()})
 			return
+		case nil:
 		default:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Unknown error"})
 			return
 		}
 
-	})
-
-	api.Post("/api/v1/signup", func(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
-		var regInfo Profile
-
-		err := json.NewDecoder(r.Body).Decode(&regInfo)
+		twoFactorService := provider.GetTwoFactorService()
+		twoFactorEnabled, err := twoFactorService.IsEnabled(profile.Id)
 		if err != nil {
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		profileService := provider.GetProfileService()
-		err = profileService.CreateProfile(&regInfo)
+		//session is opened by /signin/two_factor when code for challenge is entered,
+		//failures are kept until then, so codes can't be guessed with new challenges
+		if twoFactorEnabled {
+			challengeToken, err := twoFactorService.CreateChallenge(profile, loginInfo.Device)
+			if err != nil {
+				rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+				return
+			}
 
-		switch err {
-		case ErrAlreadyExists:
-			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
-			return
-		case nil:
-			rnd.JSON(http.StatusOK, SuccessMsg{"Welcome!"})
-			return
-		default:
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			rnd.JSON(http.StatusOK, TwoFactorRequired{
+				TwoFactorRequired: true,
+				ChallengeToken:    challengeToken,
+				ExpiresIn:         int64(loginChallengeTtl / time.Second),
+			})
 			return
 		}
-	})
 
-	api.Post("/api/v1/logout", func(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		tokens, err := provider.GetSessionService().CreateSession(profile.Id, client)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		err = profileService.AuthBySessionToken(tokenString)
+		if err := loginGuard.RegisterSuccess(loginInfo.Email, client.Ip); err != nil {
+			log.Printf("Failed to reset sign in failures: %v", err)
+		}
+
+		rnd.JSON(http.StatusOK, tokens)
+	})
+
+	//second step of sign in, TOTP or recovery code completes challenge returned by /signin
+	api.Post("/api/v1/signin/two_factor", func(mailClient pb.MailServiceClient, provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+		var signInRequest TwoFactorSignInRequest
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		err := json.NewDecoder(r.Body).Decode(&signInRequest)
+		if err != nil || signInRequest.ChallengeToken == "" {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
 			return
 		}
 
-		err = profileService.Logout(tokenString)
+		twoFactorService := provider.GetTwoFactorService()
+		pending, err := twoFactorService.GetChallenge(signInRequest.ChallengeToken)
 		switch err {
-		case ErrStorageError:
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		case ErrInvalidChallenge:
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
 			return
 		case nil:
-			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
-			return
 		default:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
-	})
 
-	api.Post("/api/v1/reset_password", func(mailClient pb.MailServiceClient, rnd render.Render, provider BaseServiceProvider, r *http.Request, w http.ResponseWriter) {
+		//locked account can't be entered with second factor either
+		ip := ClientInfoFromRequest(config, r, "").Ip
+		loginGuard := provider.GetLoginGuardService()
 
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		retryAfter, accountLocked, err := loginGuard.Reserve(pending.Email, ip)
+		switch err {
+		case ErrTooManyAttempts:
+			tooManyAttempts(rnd, w, retryAfter, err)
 			return
-		}
-
-		err = profileService.AuthBySessionToken(tokenString)
-
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		case nil:
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		/*
-			ctx, cancel := context.WithTimeout(context.TODO(), 15 * time.Second)
-			defer cancel()
-
-			sendMailRequest := &pb.SendMailRequest{Body: "TestMessage"}
-			if sendMailResponse, err := mailClient.SendMail(ctx, sendMailRequest); err == nil {
-
-			} else {
-
+		challenge, err := twoFactorService.CompleteChallenge(signInRequest.ChallengeToken, signInRequest.Code)
+		switch err {
+		case ErrInvalidChallenge:
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
+			return
+		case ErrInvalidTwoFactorCode:
+			//wrong codes count as failed sign in, so codes can't be guessed with new challenges
+			if accountLocked {
+				notifyAccountLocked(config, provider, mailClient, challenge.Email, ip)
 			}
-		*/
-	})
 
-	//PROFILES
-	//update profile info
-	api.Post("/api/v1/profiles/:profile_id", func(provider BaseServiceProvider, r *http.Request, w http.ResponseWriter) {
-
-	})
-
-	//download profile avatar
-	api.Get("/api/v1/profiles/:profile_id/avatar", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
+			return
+		case nil:
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		err = profileService.AuthBySessionToken(tokenString)
-
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		tokens, err := provider.GetSessionService().CreateSession(challenge.ProfileId, ClientInfoFromRequest(config, r, challenge.Device))
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		profileId := params["profile_id"]
-		if profileId == "" {
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Need to specify profile_id parameter"})
-			return
+		if err := loginGuard.RegisterSuccess(challenge.Email, ip); err != nil {
+			log.Printf("Failed to reset sign in failures: %v", err)
 		}
 
-		avatarFilePath, err := profileService.GetProfileAvatar(profileId)
-		avatarFileHandle, err := os.Open(avatarFilePath)
-		if err != nil {
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{ErrNotExists.Error()})
+		rnd.JSON(http.StatusOK, tokens)
+	})
+
+	//single sign-on, browser is redirected to identity provider and returns to callback with code
+	api.Get("/api/v1/oidc/login", func(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+
+		oidcService := provider.GetOidcService()
+		if !oidcService.Enabled() {
+			rnd.JSON(http.StatusNotFound, ErrorMsg{ErrOidcDisabled.Error()})
 			return
 		}
-		defer avatarFileHandle.Close()
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "image/png")
-		if _, err := io.Copy(w, avatarFileHandle); err != nil {
+		state, authorizationUrl, err := oidcService.StartLogin(r.URL.Query().Get("device"))
+		switch err {
+		case ErrOidcProvider:
+			rnd.JSON(http.StatusBadGateway, ErrorMsg{err.Error()})
+			return
+		case nil:
+		default:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
-	})
-
-	//upload profile avatar
-	api.Post("/api/v1/profiles/:profile_id/avatar", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
 
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/api/v1/oidc",
+			MaxAge:   int(oidcStateTtl / time.Second),
+			HttpOnly: true,
+			Secure:   strings.HasPrefix(config.PublicUrl, "https://"),
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, authorizationUrl, http.StatusFound)
+	})
 
-		err = profileService.AuthBySessionToken(tokenString)
+	//tokens are passed to web application in url fragment, so they don't reach server logs.
+	//When profile has two-factor authentication, fragment has challenge_token for /signin/two_factor instead
+	api.Get("/api/v1/oidc/callback", func(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		oidcService := provider.GetOidcService()
+		if !oidcService.Enabled() {
+			rnd.JSON(http.StatusNotFound, ErrorMsg{ErrOidcDisabled.Error()})
 			return
 		}
 
-		profileId := params["profile_id"]
-		if profileId == "" {
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Need to specify profile_id parameter"})
+		query := r.URL.Query()
+		if providerError := query.Get("error"); providerError != "" {
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{"Identity provider denied sign in: " + providerError})
 			return
 		}
 
-		r.ParseMultipartForm(32 << 20)
-		file, _, err := r.FormFile("avatar")
+		state, code, err := OidcCallbackParams(r)
 		if err != nil {
 			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
 			return
 		}
 
-		defer file.Close()
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/v1/oidc", MaxAge: -1})
 
-		avatarfilePath, _ := filepath.Abs("./uploads/avatar_" + profileId)
-		f, err := os.Create(avatarfilePath)
-		if err != nil {
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		identity, loginState, err := oidcService.CompleteLogin(state, code)
+		switch err {
+		case ErrOidcState:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
 			return
-		}
-
-		defer f.Close()
-		if _, err := io.Copy(f, file); err != nil {
+		case ErrOidcCodeExchange, ErrOidcIdToken:
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
+			return
+		case ErrOidcProvider:
+			rnd.JSON(http.StatusBadGateway, ErrorMsg{err.Error()})
+			return
+		case nil:
+		default:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		err = profileService.UpdateProfileAvatar(profileId, avatarfilePath)
+		profile, err := oidcService.ResolveProfile(identity)
 		switch err {
-		case nil:
-			rnd.JSON(http.StatusOK, SuccessMsg{"Update avatar success"})
+		case ErrOidcEmailNotVerified:
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
 			return
-		case ErrStorageError:
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		case nil:
 		default:
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
-	})
 
-	//get profile info
-	api.Get("/api/v1/profiles/:profile_id", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		//identity provider replaces password only, second factor of profile is still required
+		twoFactorService := provider.GetTwoFactorService()
+		twoFactorEnabled, err := twoFactorService.IsEnabled(profile.Id)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
 
-		err = profileService.AuthBySessionToken(tokenString)
+		fragment := url.Values{}
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+		if twoFactorEnabled {
+			challengeToken, err := twoFactorService.CreateChallenge(profile, loginState.Device)
+			if err != nil {
+				rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+				return
+			}
 
-		profileId := params["profile_id"]
-		if profileId == "" {
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Need to specify profile_id parameter"})
+			fragment.Set("two_factor_required", "true")
+			fragment.Set("challenge_token", challengeToken)
+			fragment.Set("expires_in", strconv.FormatInt(int64(loginChallengeTtl/time.Second), 10))
+
+			http.Redirect(w, r, config.Oidc.PostLoginUrl+"#"+fragment.Encode(), http.StatusFound)
 			return
 		}
 
-		storedProfile, err := profileService.GetProfileInfo(profileId)
-		switch err {
-		case nil:
-			rnd.JSON(http.StatusOK, storedProfile)
-			return
-		case ErrNotExists:
-			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
-			return
-		case ErrStorageError:
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"DB error"})
-			return
-		default:
+		tokens, err := provider.GetSessionService().CreateSession(profile.Id, ClientInfoFromRequest(config, r, loginState.Device))
+		if err != nil {
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
+
+		fragment.Set("profile_id", tokens.ProfileId.Hex())
+		fragment.Set("session_id", tokens.SessionId)
+		fragment.Set("access_token", tokens.AccessToken)
+		fragment.Set("refresh_token", tokens.RefreshToken)
+		fragment.Set("expires_in", strconv.FormatInt(tokens.ExpiresIn, 10))
+
+		http.Redirect(w, r, config.Oidc.PostLoginUrl+"#"+fragment.Encode(), http.StatusFound)
 	})
 
-	//ACTIVITIES
-	//create activity
-	api.Post("/api/v1/activities", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+	//exchange refresh token for new access and refresh tokens
+	api.Post("/api/v1/token/refresh", func(provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+		var refreshRequest RefreshRequest
 
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		err := json.NewDecoder(r.Body).Decode(&refreshRequest)
+		if err != nil || refreshRequest.RefreshToken == "" {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
 			return
 		}
 
-		err = profileService.AuthBySessionToken(tokenString)
-
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		tokens, err := provider.GetSessionService().Refresh(refreshRequest.RefreshToken, ClientInfoFromRequest(config, r, ""))
+		switch err {
+		case ErrUnauthoriazedAccess, ErrRefreshTokenReused:
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, tokens)
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
+	})
 
-		var activity Activity
+	api.Post("/api/v1/signup", func(mailClient pb.MailServiceClient, provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+		var regInfo Profile
 
-		err = json.NewDecoder(r.Body).Decode(&activity)
+		err := json.NewDecoder(r.Body).Decode(&regInfo)
 		if err != nil {
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadHttpRequestBody.Error()})
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
 			return
 		}
 
-		if activity.ProfileId == "" {
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadHttpRequestBody.Error()})
-			return
-		}
+		profileService := provider.GetProfileService()
+		profile, err := profileService.CreateProfile(&regInfo)
 
-		activityService := provider.GetActivityService()
-		createdActivity, err := activityService.CreateActivity(&activity)
 		switch err {
-		case nil:
-			rnd.JSON(http.StatusOK, createdActivity)
+		case ErrAlreadyExists:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
 			return
-		case ErrStorageError:
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		case nil:
 		default:
 			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
 			return
 		}
-	})
 
-	//get all activities for profile
-	api.Get("/api/v1/activities", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
+		//profile is usable in restricted mode even when mail isn't sent, link can be requested again
+		if err := sendVerificationMail(config, profileService, mailClient, profile); err != nil {
+			log.Printf("Failed to send verification mail to profile %s: %v", profile.Id.Hex(), err)
 		}
 
-		err = profileService.AuthBySessionToken(tokenString)
+		rnd.JSON(http.StatusOK, SuccessMsg{"Welcome! Check your mailbox to verify email"})
+	})
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+	//confirm email by link from verification mail
+	api.Get("/api/v1/verify_email", func(provider BaseServiceProvider, rnd render.Render, r *http.Request) {
 
-		requestParamsMap := r.URL.Query()
-		profileId := requestParamsMap.Get("profile_id")
-		if profileId == "" {
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Need to specify profile_id parameter"})
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Need to specify token parameter"})
 			return
 		}
 
-		activityService := provider.GetActivityService()
-		profileActivities, err := activityService.GetAllActivities(profileId)
+		profileService := provider.GetProfileService()
+		err := profileService.VerifyEmail(token)
 
 		switch err {
 		case nil:
-			rnd.JSON(http.StatusOK, profileActivities)
+			rnd.JSON(http.StatusOK, SuccessMsg{"Email was verified"})
+			return
+		case ErrInvalidVerifyToken:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case ErrAlreadyExists:
+			rnd.JSON(http.StatusConflict, ErrorMsg{"Email is used by another profile"})
 			return
 		case ErrStorageError:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		default:
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Unknown error"})
 			return
 		}
 	})
 
-	//get specific activity info for profile
-	api.Get("/api/v1/activities/:activity_id", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+	//send verification link again, response doesn't tell whether unverified account with email exists
+	api.Post("/api/v1/verify_email/resend", func(mailClient pb.MailServiceClient, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
 
-		err = profileService.AuthBySessionToken(tokenString)
+		var resendRequest ResendVerificationRequest
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		err := json.NewDecoder(r.Body).Decode(&resendRequest)
+		if err != nil || resendRequest.Email == "" {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
 			return
 		}
 
-		activityId := params["activity_id"]
-		activityService := provider.GetActivityService()
-		storedActivity, err := activityService.GetActivity(activityId)
+		profileService := provider.GetProfileService()
+		profile, verifyToken, err := profileService.RecreateEmailVerification(resendRequest.Email)
 
 		switch err {
 		case nil:
-			rnd.JSON(http.StatusOK, storedActivity)
+		case ErrNotExists:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Verification link was sent if unverified account exists"})
 			return
 		case ErrStorageError:
-			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		default:
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Unknown error"})
 			return
 		}
-	})
 
-	//update specific activity info for profile
-	api.Post("/api/v1/activities/:activity_id", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		err = sendTemplateMail(mailClient, profile.Email, "verify_email", verificationMailVars(config, profile, verifyToken), "verify_email:"+hashToken(verifyToken))
+		if err != nil {
+			rnd.JSON(http.StatusServiceUnavailable, ErrorMsg{err.Error()})
 			return
 		}
 
-		err = profileService.AuthBySessionToken(tokenString)
+		rnd.JSON(http.StatusOK, SuccessMsg{"Verification link was sent if unverified account exists"})
+	})
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+	//request password reset, response doesn't tell whether account with email exists
+	api.Post("/api/v1/reset_password", func(mailClient pb.MailServiceClient, rnd render.Render, provider BaseServiceProvider, r *http.Request, w http.ResponseWriter) {
 
-		var activity Activity
+		var resetRequest PasswordResetRequest
 
-		err = json.NewDecoder(r.Body).Decode(&activity)
-		if err != nil {
+		err := json.NewDecoder(r.Body).Decode(&resetRequest)
+		if err != nil || resetRequest.Email == "" {
 			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
 			return
 		}
 
-		activityService := provider.GetActivityService()
-		err = activityService.UpdateActivity(&activity)
+		ip := ClientInfoFromRequest(config, r, "").Ip
+		retryAfter, err := provider.GetLoginGuardService().ReservePasswordReset(ip)
 		switch err {
-		case nil:
-			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
-			return
-		case ErrStorageError:
-			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		case ErrTooManyResetRequests:
+			tooManyAttempts(rnd, w, retryAfter, err)
 			return
+		case nil:
 		default:
-			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
-	})
 
-	//delete specific activity info for profile
-	api.Delete("/api/v1/activities/:activity_id", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+		profileService := provider.GetProfileService()
+		profile, resetToken, err := profileService.CreatePasswordResetToken(resetRequest.Email)
+
+		switch err {
+		case nil:
+		case ErrProfileDoesntExist, ErrNotExists:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Password reset instructions were sent if account exists"})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Unknown error"})
+			return
+		}
+
+		err = sendTemplateMail(mailClient, profile.Email, "password_reset", map[string]string{
+			"username":   profile.UserName,
+			"reset_url":  config.PublicUrl + "/reset_password?token=" + resetToken,
+			"token":      resetToken,
+			"expires_in": strconv.Itoa(int(passwordResetTtl / time.Minute)),
+		}, "password_reset:"+hashToken(resetToken))
+
+		//failure isn't reported to client, it would tell that account exists
+		if err != nil {
+			log.Printf("Failed to send password reset mail: %v", err)
+		}
+
+		rnd.JSON(http.StatusOK, SuccessMsg{"Password reset instructions were sent if account exists"})
+	})
+
+	//set new password by emailed token, all sessions of profile are closed
+	api.Post("/api/v1/reset_password/confirm", func(rnd render.Render, provider BaseServiceProvider, r *http.Request) {
+
+		var confirm PasswordResetConfirm
+
+		err := json.NewDecoder(r.Body).Decode(&confirm)
+		if err != nil || confirm.Token == "" {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		profileService := provider.GetProfileService()
+		err = profileService.ResetPassword(confirm.Token, confirm.Password)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Password was changed"})
+			return
+		case ErrInvalidResetToken, ErrWeakPassword:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Unknown error"})
+			return
+		}
+	})
+
+	//calendar feed, authorized by feed token because calendar apps can't send headers
+	api.Get("/api/v1/profiles/:profile_id/calendar.ics", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		profileId := params["profile_id"]
+		calendarService := provider.GetCalendarService()
+
+		err := calendarService.AuthByCalendarToken(profileId, r.URL.Query().Get("token"))
+		switch err {
+		case nil:
+		case ErrUnauthoriazedAccess:
+			rnd.JSON(http.StatusUnauthorized, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		if err := calendarService.WriteCalendar(profileId, w); err != nil {
+			log.Printf("Calendar feed failed: %v", err)
+		}
+	})
+
+	//public keys for services which verify access tokens themselves
+	api.Get("/.well-known/jwks.json", func(rnd render.Render) {
+		rnd.JSON(http.StatusOK, keys.Jwks())
+	})
+
+	api.Get("/", func(r render.Render) {
+		r.HTML(200, "index", nil)
+	})
+
+	//all other routes require authentication, Authenticate maps AuthContext or answers 401
+	api.Group("", func(protected martini.Router) {
+		registerProtectedRoutes(protected, config)
+	}, Authenticate)
+
+	return api
+}
+
+//tooManyAttempts answers 429 with Retry-After in seconds, rounded up
+func tooManyAttempts(rnd render.Render, w http.ResponseWriter, retryAfter time.Duration, err error) {
+
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	rnd.JSON(http.StatusTooManyRequests, ErrorMsg{err.Error()})
+}
+
+//notifyAccountLocked mails account owner when failed attempt locked account
+func notifyAccountLocked(config *Config, provider BaseServiceProvider, mailClient pb.MailServiceClient, email string, ip string) {
+
+	if err := sendAccountLockedMail(config, provider.GetProfileService(), mailClient, email, ip); err != nil {
+		log.Printf("Failed to send account locked mail: %v", err)
+	}
+}
+
+//abortResponse drops connection of response which is already being streamed
+func abortResponse(w http.ResponseWriter) {
+
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+
+	panic(http.ErrAbortHandler)
+}
+
+//workspaceError answers errors of workspace routes
+func workspaceError(rnd render.Render, err error) {
+
+	switch err {
+	case ErrNotExists:
+		rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+	case ErrForbidden, ErrEmailNotVerified, ErrInviteEmailMismatch:
+		rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+	case ErrAlreadyExists:
+		rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+	case ErrBadRole, ErrBadEmail, ErrInvalidInvite:
+		rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+	case ErrSendMail:
+		rnd.JSON(http.StatusBadGateway, ErrorMsg{err.Error()})
+	default:
+		rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+	}
+}
+
+//registerProtectedRoutes adds routes available only with AuthContext of authenticated caller
+func registerProtectedRoutes(api martini.Router, config *Config) {
+
+	api.Post("/api/v1/logout", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+
+		err := provider.GetSessionService().RevokeSession(auth.ProfileId, auth.SessionId)
+		switch err {
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		case nil, ErrNotExists:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//SESSIONS
+	//list active sessions of caller
+	api.Get("/api/v1/sessions", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render) {
+
+		sessions, err := provider.GetSessionService().ListSessions(auth.ProfileId)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		for i := range sessions {
+			sessions[i].Current = sessions[i].Id.Hex() == auth.SessionId
+		}
+
+		rnd.JSON(http.StatusOK, sessions)
+	})
+
+	//revoke one session of caller
+	api.Delete("/api/v1/sessions/:session_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		err := provider.GetSessionService().RevokeSession(auth.ProfileId, params["session_id"])
+		switch err {
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//revoke all sessions of caller, current one is kept with except_current=true
+	api.Delete("/api/v1/sessions", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+
+		exceptSessionId := ""
+		if r.URL.Query().Get("except_current") == "true" {
+			exceptSessionId = auth.SessionId
+		}
+
+		if _, err := provider.GetSessionService().RevokeAllSessions(auth.ProfileId, exceptSessionId); err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+	})
+
+	//API TOKENS
+	api.Get("/api/v1/api_tokens", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render) {
+
+		apiTokens, err := provider.GetApiTokenService().ListApiTokens(auth.ProfileId)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		rnd.JSON(http.StatusOK, apiTokens)
+	})
+
+	//create token, it is shown only in this response
+	api.Post("/api/v1/api_tokens", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+		var tokenRequest ApiTokenRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		createdToken, err := provider.GetApiTokenService().CreateApiToken(auth.ProfileId, &tokenRequest)
+		switch err {
+		case ErrBadHttpRequestBody, ErrBadScope:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case ErrTooManyApiTokens:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, createdToken)
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	api.Delete("/api/v1/api_tokens/:token_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		err := provider.GetApiTokenService().RevokeApiToken(auth.ProfileId, params["token_id"])
+		switch err {
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//TWO-FACTOR AUTHENTICATION
+	//start enrollment, returned secret is added to authenticator application
+	api.Post("/api/v1/two_factor/enroll", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render) {
+
+		profile, err := provider.GetProfileService().GetProfileInfo(auth.ProfileId.Hex())
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		enrollment, err := provider.GetTwoFactorService().BeginEnrollment(profile)
+		switch err {
+		case ErrTwoFactorEnabled:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, enrollment)
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//confirm enrollment by code from authenticator application, recovery codes are shown once
+	api.Post("/api/v1/two_factor/verify", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+		var codeRequest TwoFactorCodeRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&codeRequest); err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		recoveryCodes, err := provider.GetTwoFactorService().ConfirmEnrollment(auth.ProfileId, codeRequest.Code)
+		switch err {
+		case ErrTwoFactorNotEnrolling:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+			return
+		case ErrInvalidTwoFactorCode:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, RecoveryCodesResponse{recoveryCodes})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	api.Post("/api/v1/two_factor/disable", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+		var codeRequest TwoFactorCodeRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&codeRequest); err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		err := provider.GetTwoFactorService().Disable(auth.ProfileId, codeRequest.Code)
+		switch err {
+		case ErrTwoFactorNotEnabled:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+			return
+		case ErrInvalidTwoFactorCode:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Two-factor authentication is disabled"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//PROFILES
+	//update profile info
+	api.Post("/api/v1/profiles/:profile_id", RequireScope(ScopeAccount), func(auth *AuthContext, mailClient pb.MailServiceClient, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		var update ProfileUpdate
+
+		err = json.NewDecoder(r.Body).Decode(&update)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		profileService := provider.GetProfileService()
+		result, err := profileService.UpdateProfileInfo(profileId, auth.SessionId, &update)
+
+		switch err {
+		case nil:
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		case ErrWrongPassword:
+			rnd.JSON(http.StatusForbidden, ErrorMsg{"Current password is wrong"})
+			return
+		case ErrAlreadyExists:
+			rnd.JSON(http.StatusConflict, ErrorMsg{"Email is used by another profile"})
+			return
+		case ErrBadHttpRequestBody, ErrBadEmail, ErrWeakPassword:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"Unknown error"})
+			return
+		}
+
+		//confirmation link goes to new address, current email is kept until it is opened
+		if result.PendingEmail != "" {
+			pending := *result.Profile
+			pending.Email = result.PendingEmail
+
+			if err := sendVerificationMail(config, profileService, mailClient, &pending); err != nil {
+				rnd.JSON(http.StatusServiceUnavailable, ErrorMsg{err.Error()})
+				return
+			}
+		}
+
+		rnd.JSON(http.StatusOK, result)
+	})
+
+	//download profile avatar
+	api.Get("/api/v1/profiles/:profile_id/avatar", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		profileService := provider.GetProfileService()
+
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		avatarFilePath, err := profileService.GetProfileAvatar(profileId)
+		avatarFileHandle, err := os.Open(avatarFilePath)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{ErrNotExists.Error()})
+			return
+		}
+		defer avatarFileHandle.Close()
+
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "image/png")
+		if _, err := io.Copy(w, avatarFileHandle); err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//upload profile avatar
+	api.Post("/api/v1/profiles/:profile_id/avatar", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		profileService := provider.GetProfileService()
+
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		r.ParseMultipartForm(32 << 20)
+		file, _, err := r.FormFile("avatar")
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+
+		defer file.Close()
+
+		avatarfilePath, _ := filepath.Abs("./uploads/avatar_" + profileId)
+		f, err := os.Create(avatarfilePath)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		defer f.Close()
+		if _, err := io.Copy(f, file); err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		err = profileService.UpdateProfileAvatar(profileId, avatarfilePath)
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Update avatar success"})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		default:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//get profile info
+	api.Get("/api/v1/profiles/:profile_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		profileService := provider.GetProfileService()
+
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		storedProfile, err := profileService.GetProfileInfo(profileId)
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, storedProfile)
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{"DB error"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//ACTIVITIES
+	//create activity
+	api.Post("/api/v1/activities", RequireScope(ScopeActivitiesWrite), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		var activity Activity
+
+		err := json.NewDecoder(r.Body).Decode(&activity)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadHttpRequestBody.Error()})
+			return
+		}
+
+		profileId, err := auth.OwnProfile(activity.ProfileId.Hex())
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		if err := provider.GetWorkspaceService().CheckActivityWorkspace(auth.ProfileId, activity.WorkspaceId); err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		activityService := provider.GetActivityService()
+		createdActivity, err := activityService.CreateActivity(profileId, &activity)
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, createdActivity)
+			return
+		case ErrIllegalStateTransition:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+		default:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//get all activities for profile, workspace admin gets activities of member shared with workspace_id
+	api.Get("/api/v1/activities", RequireScope(ScopeActivitiesRead), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		requestParamsMap := r.URL.Query()
+		filter, err := ParseActivityFilter(requestParamsMap)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+
+		profileId, err := provider.GetWorkspaceService().ReadableProfile(auth, requestParamsMap.Get("profile_id"), filter.WorkspaceId)
+		switch err {
+		case nil:
+		case ErrForbidden:
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		page, err := ParsePageRequest(requestParamsMap)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+
+		activityService := provider.GetActivityService()
+		profileActivities, err := activityService.GetAllActivities(profileId, filter, page)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, profileActivities)
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//export work intervals of profile activities
+	api.Get("/api/v1/activities/export", RequireScope(ScopeActivitiesRead), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+
+		requestParamsMap := r.URL.Query()
+		profileId, err := auth.OwnProfile(requestParamsMap.Get("profile_id"))
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		profileService := provider.GetProfileService()
+		err = profileService.CheckFeatureAllowed(auth.ProfileId, FeatureExport)
+		if err == ErrEmailNotVerified {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		filter, err := ParseActivityFilter(requestParamsMap)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+
+		location := time.UTC
+		if tz := requestParamsMap.Get("tz"); tz != "" {
+			if location, err = time.LoadLocation(tz); err != nil {
+				rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadQueryParams.Error()})
+				return
+			}
+		}
+
+		format := requestParamsMap.Get("format")
+		if format == "" {
+			format = ExportFormatCsv
+		}
+
+		if format != ExportFormatCsv && format != ExportFormatXlsx {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadQueryParams.Error()})
+			return
+		}
+
+		w.Header().Set("Content-Type", ExportContentType(format))
+		w.Header().Set("Content-Disposition", "attachment; filename=activities."+format)
+		w.WriteHeader(http.StatusOK)
+
+		rowWriter, err := NewRowWriter(format, w)
+		if err != nil {
+			log.Printf("Export failed: %v", err)
+			abortResponse(w)
+			return
+		}
+
+		if err := rowWriter.WriteRow([]interface{}{"Description", "Category", "Start", "End", "Duration", "Duration, sec"}); err != nil {
+			log.Printf("Export failed: %v", err)
+			abortResponse(w)
+			return
+		}
+
+		now := time.Now().Unix()
+		activityService := provider.GetActivityService()
+		err = activityService.ExportWorkIntervals(profileId, filter, func(e *ExportedInterval) error {
+			end, stop := "", e.Interval.Stop
+			if stop == 0 {
+				stop = now
+			} else {
+				end = time.Unix(stop, 0).In(location).Format("2006-01-02 15:04:05")
+			}
+
+			duration := stop - e.Interval.Start
+			if duration < 0 {
+				duration = 0
+			}
+
+			return rowWriter.WriteRow([]interface{}{
+				e.Description,
+				e.Category,
+				time.Unix(e.Interval.Start, 0).In(location).Format("2006-01-02 15:04:05"),
+				end,
+				fmt.Sprintf("%d:%02d:%02d", duration/3600, duration/60%60, duration%60),
+				duration,
+			})
+		})
+
+		//file isn't completed after failure, so client sees failed download instead of truncated file
+		if err != nil {
+			log.Printf("Export failed: %v", err)
+			abortResponse(w)
+			return
+		}
+
+		if err := rowWriter.Close(); err != nil {
+			log.Printf("Export failed: %v", err)
+		}
+	})
+
+	//import activities from csv, toggl or clockify export
+	api.Post("/api/v1/activities/import", RequireScope(ScopeActivitiesWrite), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request, w http.ResponseWriter) {
+
+		requestParamsMap := r.URL.Query()
+		profileId, err := auth.OwnProfile(requestParamsMap.Get("profile_id"))
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
 
 		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		err = profileService.CheckFeatureAllowed(auth.ProfileId, FeatureImport)
+		if err == ErrEmailNotVerified {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		location := time.UTC
+		if tz := requestParamsMap.Get("tz"); tz != "" {
+			if location, err = time.LoadLocation(tz); err != nil {
+				rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadQueryParams.Error()})
+				return
+			}
+		}
+
+		dryRun := false
+		if value := requestParamsMap.Get("dry_run"); value != "" {
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				rnd.JSON(http.StatusBadRequest, ErrorMsg{ErrBadQueryParams.Error()})
+				return
+			}
+		}
+
+		format := requestParamsMap.Get("format")
+		if format == "" {
+			format = ImportFormatCsv
+		}
+
+		var body io.Reader = http.MaxBytesReader(w, r.Body, 32<<20)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.Body = body.(io.ReadCloser)
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+				return
+			}
+
+			defer file.Close()
+			body = file
+		}
+
+		rows, err := ParseImport(format, body, location)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+
+		activityService := provider.GetActivityService()
+		importResult, err := activityService.ImportActivities(profileId, rows, dryRun)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, importResult)
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//get running activity for profile
+	api.Get("/api/v1/activities/current", RequireScope(ScopeActivitiesRead), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+
+		profileId, err := auth.OwnProfile(r.URL.Query().Get("profile_id"))
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		activityService := provider.GetActivityService()
+		runningActivity, err := activityService.GetCurrentActivity(profileId)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, CurrentActivity{Activity: runningActivity, Elapsed: runningActivity.Elapsed(time.Now().Unix())})
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusOK, CurrentActivity{})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//get specific activity info for profile
+	api.Get("/api/v1/activities/:activity_id", RequireScope(ScopeActivitiesRead), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		activityId := params["activity_id"]
+		activityService := provider.GetActivityService()
+		storedActivity, err := activityService.GetActivity(auth.ProfileId.Hex(), activityId)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, storedActivity)
+			return
+		case ErrNotExists, ErrStorageError:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//update specific activity info for profile
+	api.Post("/api/v1/activities/:activity_id", RequireScope(ScopeActivitiesWrite), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
+
+		var activity Activity
+
+		err := json.NewDecoder(r.Body).Decode(&activity)
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		activityId := params["activity_id"]
+		if !bson.IsObjectIdHex(activityId) {
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		}
+
+		activity.Id = bson.ObjectIdHex(activityId)
+
+		if err := provider.GetWorkspaceService().CheckActivityWorkspace(auth.ProfileId, activity.WorkspaceId); err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		activityService := provider.GetActivityService()
+		err = activityService.UpdateActivity(auth.ProfileId.Hex(), &activity)
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//stop sharing activity with workspace, update keeps workspace_id when it's omitted
+	api.Delete("/api/v1/activities/:activity_id/workspace", RequireScope(ScopeActivitiesWrite), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		err := provider.GetActivityService().UnshareActivity(auth.ProfileId.Hex(), params["activity_id"])
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
 		}
+	})
 
-		err = profileService.AuthBySessionToken(tokenString)
+	//activity timer
+	api.Post("/api/v1/activities/:activity_id/start", RequireScope(ScopeActivitiesWrite), activityTransitionHandler((*ActivitiesService).StartActivity))
+	api.Post("/api/v1/activities/:activity_id/pause", RequireScope(ScopeActivitiesWrite), activityTransitionHandler((*ActivitiesService).PauseActivity))
+	api.Post("/api/v1/activities/:activity_id/resume", RequireScope(ScopeActivitiesWrite), activityTransitionHandler((*ActivitiesService).ResumeActivity))
+	api.Post("/api/v1/activities/:activity_id/stop", RequireScope(ScopeActivitiesWrite), activityTransitionHandler((*ActivitiesService).StopActivity))
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+	//delete specific activity info for profile
+	api.Delete("/api/v1/activities/:activity_id", RequireScope(ScopeActivitiesWrite), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
 
 		activityId := params["activity_id"]
 		activityService := provider.GetActivityService()
-		err = activityService.DeleteActivity(activityId)
+		err := activityService.DeleteActivity(auth.ProfileId.Hex(), activityId)
 
 		switch err {
 		case nil:
 			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
 			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
 		case ErrStorageError:
 			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
 			return
@@ -494,19 +1395,11 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 
 	//SETTINGS
 	//update settings for specific profile
-	api.Post("/api/v1/profiles/:profile_id/settings", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
+	api.Post("/api/v1/profiles/:profile_id/settings", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
 
-		err = profileService.AuthBySessionToken(tokenString)
-
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
 			return
 		}
 
@@ -518,7 +1411,6 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 			return
 		}
 
-		profileId := params["profile_id"]
 		settingsService := provider.GetSettingsService()
 		err = settingsService.UpdateSettings(profileId, &settings)
 		switch err {
@@ -535,23 +1427,14 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 	})
 
 	//get settings for specific profile
-	api.Get("/api/v1/profiles/:profile_id/settings", func(provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
-
-		profileService := provider.GetProfileService()
-		tokenString, err := profileService.ExtractTokenFromRequest(r)
-		if err == ErrParseAuthorizationHeader {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
-			return
-		}
-
-		err = profileService.AuthBySessionToken(tokenString)
+	api.Get("/api/v1/profiles/:profile_id/settings", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request, w http.ResponseWriter) {
 
-		if err == ErrUnauthoriazedAccess {
-			rnd.JSON(http.StatusUnauthorized, ErrorMsg{ErrUnauthoriazedAccess.Error()})
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
 			return
 		}
 
-		profileId := params["profile_id"]
 		settingsService := provider.GetSettingsService()
 		storedProfileSettings, err := settingsService.GetSettings(profileId)
 
@@ -569,9 +1452,349 @@ func InitializeApi(config *Config) *martini.ClassicMartini {
 		}
 	})
 
-	api.Get("/", func(r render.Render) {
-		r.HTML(200, "index", nil)
+	//REPORTS
+	//get tracked time report for specific profile, workspace admin gets report of member by workspace_id
+	api.Get("/api/v1/profiles/:profile_id/reports", RequireScope(ScopeReportsRead), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request) {
+
+		reportRequest, err := ParseReportRequest(r.URL.Query())
+		if err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
+
+		profileId, err := provider.GetWorkspaceService().ReadableProfile(auth, params["profile_id"], reportRequest.WorkspaceId)
+		switch err {
+		case nil:
+		case ErrForbidden:
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		reportsService := provider.GetReportsService()
+		report, err := reportsService.GetReport(profileId, reportRequest)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, report)
+			return
+		case ErrStorageError:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		}
 	})
 
-	return api
+	//WORKSPACES
+	api.Post("/api/v1/workspaces", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+		var workspaceRequest WorkspaceRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&workspaceRequest); err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		workspace, err := provider.GetWorkspaceService().CreateWorkspace(auth.ProfileId, workspaceRequest.Name)
+		switch err {
+		case ErrBadHttpRequestBody:
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{err.Error()})
+			return
+		case nil:
+			rnd.JSON(http.StatusOK, WorkspaceMembership{Workspace: *workspace, Role: RoleOwner})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//workspaces of caller with caller role
+	api.Get("/api/v1/workspaces", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render) {
+
+		workspaces, err := provider.GetWorkspaceService().ListWorkspaces(auth.ProfileId)
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		rnd.JSON(http.StatusOK, workspaces)
+	})
+
+	api.Delete("/api/v1/workspaces/:workspace_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		workspaceService := provider.GetWorkspaceService()
+		owner, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleOwner)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		if err := workspaceService.DeleteWorkspace(owner.WorkspaceId); err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+	})
+
+	api.Get("/api/v1/workspaces/:workspace_id/members", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		workspaceService := provider.GetWorkspaceService()
+		member, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleViewer)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		members, err := workspaceService.ListMembers(member.WorkspaceId)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, members)
+	})
+
+	//change role of member
+	api.Post("/api/v1/workspaces/:workspace_id/members/:profile_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request) {
+		var roleRequest WorkspaceRoleRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&roleRequest); err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		workspaceService := provider.GetWorkspaceService()
+		actor, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleAdmin)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		if err := workspaceService.ChangeRole(actor, params["profile_id"], roleRequest.Role); err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+	})
+
+	//remove member, any member can remove itself to leave workspace
+	api.Delete("/api/v1/workspaces/:workspace_id/members/:profile_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		workspaceService := provider.GetWorkspaceService()
+		actor, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleViewer)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		if err := workspaceService.RemoveMember(actor, params["profile_id"]); err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+	})
+
+	//invite by email, unverified profiles can't invite
+	api.Post("/api/v1/workspaces/:workspace_id/invites", RequireScope(ScopeAccount), func(auth *AuthContext, mailClient pb.MailServiceClient, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request) {
+		var inviteRequest WorkspaceInviteRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&inviteRequest); err != nil {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		profileService := provider.GetProfileService()
+		if err := profileService.CheckFeatureAllowed(auth.ProfileId, FeatureInvites); err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		workspaceService := provider.GetWorkspaceService()
+		actor, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleAdmin)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		workspace, err := workspaceService.GetWorkspace(actor.WorkspaceId)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		inviter, err := profileService.GetProfileInfo(auth.ProfileId.Hex())
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		invite, token, err := workspaceService.CreateInvite(actor, &inviteRequest)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		if err := sendWorkspaceInviteMail(config, mailClient, workspace, inviter, invite, token); err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, invite)
+	})
+
+	api.Get("/api/v1/workspaces/:workspace_id/invites", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		workspaceService := provider.GetWorkspaceService()
+		actor, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleAdmin)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		invites, err := workspaceService.ListInvites(actor.WorkspaceId)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, invites)
+	})
+
+	api.Delete("/api/v1/workspaces/:workspace_id/invites/:invite_id", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		workspaceService := provider.GetWorkspaceService()
+		actor, err := workspaceService.RequireRole(params["workspace_id"], auth.ProfileId, RoleAdmin)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		if err := workspaceService.RevokeInvite(actor.WorkspaceId, params["invite_id"]); err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+	})
+
+	//accept invitation by token from mail
+	api.Post("/api/v1/workspace_invites/accept", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, r *http.Request) {
+		var acceptRequest AcceptInviteRequest
+
+		if err := json.NewDecoder(r.Body).Decode(&acceptRequest); err != nil || acceptRequest.Token == "" {
+			rnd.JSON(http.StatusBadRequest, ErrorMsg{"Unformat request body"})
+			return
+		}
+
+		profile, err := provider.GetProfileService().GetProfileInfo(auth.ProfileId.Hex())
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		membership, err := provider.GetWorkspaceService().AcceptInvite(profile, acceptRequest.Token)
+		if err != nil {
+			workspaceError(rnd, err)
+			return
+		}
+
+		rnd.JSON(http.StatusOK, membership)
+	})
+
+	//CALENDAR
+	//issue new calendar feed token, previous one is revoked
+	api.Post("/api/v1/profiles/:profile_id/calendar_token", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request) {
+
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		profileService := provider.GetProfileService()
+		err = profileService.CheckFeatureAllowed(auth.ProfileId, FeatureCalendar)
+		if err == ErrEmailNotVerified {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		if err != nil {
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+
+		calendarService := provider.GetCalendarService()
+		calendarToken, err := calendarService.CreateCalendarToken(profileId)
+
+		switch err {
+		case nil:
+			feedUrl := "/api/v1/profiles/" + profileId + "/calendar.ics?token=" + calendarToken
+			rnd.JSON(http.StatusOK, CalendarTokenInfo{Token: calendarToken, FeedUrl: feedUrl})
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+
+	//revoke calendar feed token
+	api.Delete("/api/v1/profiles/:profile_id/calendar_token", RequireScope(ScopeAccount), func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params, r *http.Request) {
+
+		profileId, err := auth.OwnProfile(params["profile_id"])
+		if err != nil {
+			rnd.JSON(http.StatusForbidden, ErrorMsg{err.Error()})
+			return
+		}
+
+		calendarService := provider.GetCalendarService()
+		err = calendarService.RevokeCalendarToken(profileId)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, SuccessMsg{"Success"})
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	})
+}
+
+//activityTransitionHandler makes handler for timer operation of specific activity
+func activityTransitionHandler(transition func(*ActivitiesService, string, string) (*Activity, error)) martini.Handler {
+
+	return func(auth *AuthContext, provider BaseServiceProvider, rnd render.Render, params martini.Params) {
+
+		activityId := params["activity_id"]
+		activityService := provider.GetActivityService()
+		updatedActivity, err := transition(activityService, auth.ProfileId.Hex(), activityId)
+
+		switch err {
+		case nil:
+			rnd.JSON(http.StatusOK, updatedActivity)
+			return
+		case ErrNotExists:
+			rnd.JSON(http.StatusNotFound, ErrorMsg{"Not found"})
+			return
+		case ErrIllegalStateTransition:
+			rnd.JSON(http.StatusConflict, ErrorMsg{err.Error()})
+			return
+		default:
+			rnd.JSON(http.StatusInternalServerError, ErrorMsg{err.Error()})
+			return
+		}
+	}
 }
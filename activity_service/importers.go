@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ImportFormatCsv      = "csv"
+	ImportFormatToggl    = "toggl"
+	ImportFormatClockify = "clockify"
+)
+
+var importDateLayouts = []string{"2006-01-02", "01/02/2006", "02.01.2006"}
+var importClockLayouts = []string{"15:04:05", "15:04", "03:04:05 PM", "3:04:05 PM", "03:04 PM", "3:04 PM"}
+var importTimestampLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04"}
+
+//ParseImport reads time entries of csv, toggl or clockify export. Toggl and clockify
+//exports are accepted both as csv and json. Times without offset are read in location
+func ParseImport(format string, r io.Reader, location *time.Location) ([]ImportRow, error) {
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, ErrBadHttpRequestBody
+	}
+
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	trimmed := bytes.TrimSpace(data)
+	isJson := bytes.HasPrefix(trimmed, []byte("[")) || bytes.HasPrefix(trimmed, []byte("{"))
+
+	switch format {
+	case ImportFormatCsv:
+		return parseCsvImport(bytes.NewReader(data), format, location)
+	case ImportFormatToggl:
+		if isJson {
+			return parseTogglJson(trimmed, location)
+		}
+
+		return parseCsvImport(bytes.NewReader(data), format, location)
+	case ImportFormatClockify:
+		if isJson {
+			return parseClockifyJson(trimmed, location)
+		}
+
+		return parseCsvImport(bytes.NewReader(data), format, location)
+	default:
+		return nil, ErrBadQueryParams
+	}
+}
+
+//parseCsvImport handles own csv format with start and end columns as well as
+//toggl and clockify csv exports with separate date and time columns
+func parseCsvImport(r io.Reader, source string, location *time.Location) ([]ImportRow, error) {
+
+	csvReader := csv.NewReader(bufio.NewReader(r))
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, ErrBadHttpRequestBody
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	column := func(record []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+		}
+
+		return ""
+	}
+
+	rows := []ImportRow{}
+	for line := 2; ; line++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, ErrBadHttpRequestBody
+		}
+
+		row := ImportRow{
+			Row:         line,
+			ExternalId:  column(record, "external_id", "id"),
+			Description: column(record, "description"),
+			Category:    column(record, "category", "project"),
+		}
+
+		if start := column(record, "start"); start != "" {
+			row.Start, row.Err = parseImportTimestamp(start, location)
+			if row.Err == nil {
+				row.End, row.Err = parseImportTimestamp(column(record, "end"), location)
+			}
+		} else {
+			row.Start, row.Err = parseImportDateTime(column(record, "start date"), column(record, "start time"), location)
+			if row.Err == nil {
+				row.End, row.Err = parseImportDateTime(column(record, "end date"), column(record, "end time"), location)
+			}
+		}
+
+		rows = append(rows, finishImportRow(row, source))
+	}
+
+	return rows, nil
+}
+
+type togglEntry struct {
+	Id          json.Number `json:"id"`
+	Description string      `json:"description"`
+	Start       string      `json:"start"`
+	Stop        string      `json:"stop"`
+	End         string      `json:"end"`
+	Project     string      `json:"project"`
+}
+
+//parseTogglJson accepts both time entries list and detailed report with data field
+func parseTogglJson(data []byte, location *time.Location) ([]ImportRow, error) {
+
+	var err error
+	entries := []togglEntry{}
+	if bytes.HasPrefix(data, []byte("{")) {
+		report := struct {
+			Data []togglEntry `json:"data"`
+		}{}
+
+		err = json.Unmarshal(data, &report)
+		entries = report.Data
+	} else {
+		err = json.Unmarshal(data, &entries)
+	}
+
+	if err != nil {
+		return nil, ErrBadHttpRequestBody
+	}
+
+	rows := make([]ImportRow, 0, len(entries))
+	for i, entry := range entries {
+		row := ImportRow{
+			Row:         i + 1,
+			ExternalId:  entry.Id.String(),
+			Description: entry.Description,
+			Category:    entry.Project,
+		}
+
+		stop := entry.Stop
+		if stop == "" {
+			stop = entry.End
+		}
+
+		row.Start, row.Err = parseImportTimestamp(entry.Start, location)
+		if row.Err == nil {
+			row.End, row.Err = parseImportTimestamp(stop, location)
+		}
+
+		rows = append(rows, finishImportRow(row, ImportFormatToggl))
+	}
+
+	return rows, nil
+}
+
+type clockifyEntry struct {
+	Id           string `json:"id"`
+	Description  string `json:"description"`
+	ProjectName  string `json:"projectName"`
+	TimeInterval struct {
+		Start string `json:"start"`
+		End   string `json:"end"`
+	} `json:"timeInterval"`
+	Project *struct {
+		Name string `json:"name"`
+	} `json:"project"`
+}
+
+func parseClockifyJson(data []byte, location *time.Location) ([]ImportRow, error) {
+
+	entries := []clockifyEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, ErrBadHttpRequestBody
+	}
+
+	rows := make([]ImportRow, 0, len(entries))
+	for i, entry := range entries {
+		row := ImportRow{
+			Row:         i + 1,
+			ExternalId:  entry.Id,
+			Description: entry.Description,
+			Category:    entry.ProjectName,
+		}
+
+		if entry.Project != nil && entry.Project.Name != "" {
+			row.Category = entry.Project.Name
+		}
+
+		row.Start, row.Err = parseImportTimestamp(entry.TimeInterval.Start, location)
+		if row.Err == nil {
+			row.End, row.Err = parseImportTimestamp(entry.TimeInterval.End, location)
+		}
+
+		rows = append(rows, finishImportRow(row, ImportFormatClockify))
+	}
+
+	return rows, nil
+}
+
+//finishImportRow validates row and makes external id unique within source.
+//Rows without id get id from their content, so repeated import is recognized
+func finishImportRow(row ImportRow, source string) ImportRow {
+
+	if row.Err == nil && row.End < row.Start {
+		row.Err = fmt.Errorf("end is before start")
+	}
+
+	if row.Err == nil && row.Description == "" && row.Category == "" {
+		row.Err = fmt.Errorf("description or category is required")
+	}
+
+	if row.ExternalId == "" {
+		hash := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%d|%d", row.Description, row.Category, row.Start, row.End)))
+		row.ExternalId = hex.EncodeToString(hash[:])
+	}
+
+	row.ExternalId = source + ":" + row.ExternalId
+	return row
+}
+
+func parseImportTimestamp(value string, location *time.Location) (int64, error) {
+
+	if value == "" {
+		return 0, fmt.Errorf("time is missing")
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, nil
+	}
+
+	for _, layout := range importTimestampLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t.Unix(), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown time format %q", value)
+}
+
+func parseImportDateTime(date string, clock string, location *time.Location) (int64, error) {
+
+	if date == "" || clock == "" {
+		return 0, fmt.Errorf("date or time is missing")
+	}
+
+	for _, dateLayout := range importDateLayouts {
+		for _, clockLayout := range importClockLayouts {
+			if t, err := time.ParseInLocation(dateLayout+" "+clockLayout, date+" "+clock, location); err == nil {
+				return t.Unix(), nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("unknown date format %q %q", date, clock)
+}
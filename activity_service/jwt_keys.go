@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var (
+	ErrBadJwtKey = errors.New("Bad jwt key configuration")
+	ErrNoJwtKeys = errors.New("No jwt keys configured, add jwt.keys or set jwt.ephemeral_key for development")
+)
+
+//JwtConfig describes access tokens. Token is signed by active key, other keys are
+//only used to verify tokens issued before rotation, they may have public key only
+type JwtConfig struct {
+	Issuer    string         `json:"issuer"`
+	Audience  string         `json:"audience"`
+	ActiveKey string         `json:"active_key"`
+	Keys      []JwtKeyConfig `json:"keys"`
+
+	//EphemeralKey allows to start without keys for development. Random key is generated
+	//on start, so tokens don't survive restart and aren't accepted by other replicas
+	EphemeralKey bool `json:"ephemeral_key"`
+}
+
+//JwtKeyConfig holds key material inline or in PEM files. HS256 uses secret,
+//RS256 and EdDSA use PKCS#8 (or PKCS#1 for RSA) private key and PKIX public key
+type JwtKeyConfig struct {
+	Id             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret"`
+	SecretFile     string `json:"secret_file"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+//SigningMethodEdDSA adds Ed25519 signatures to jwt-go, which knows only HMAC, RSA and ECDSA
+type SigningMethodEdDSA struct{}
+
+var signingMethodEdDSA = &SigningMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(AlgEdDSA, func() jwt.SigningMethod {
+		return signingMethodEdDSA
+	})
+}
+
+func (m *SigningMethodEdDSA) Alg() string {
+	return AlgEdDSA
+}
+
+func (m *SigningMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
+
+func (m *SigningMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+type jwtKey struct {
+	id         string
+	method     jwt.SigningMethod
+	signKey    interface{}
+	verifyKey  interface{}
+	publicOnly bool
+}
+
+//JwtKeySet signs access tokens and verifies them by kid header
+type JwtKeySet struct {
+	issuer   string
+	audience string
+	active   *jwtKey
+	keys     map[string]*jwtKey
+}
+
+type Jwk struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JwkSet struct {
+	Keys []Jwk `json:"keys"`
+}
+
+//LoadJwtKeys reads keys of config. Without configured keys ErrNoJwtKeys is returned unless
+//ephemeral_key is enabled, then Ed25519 key is generated and access tokens become invalid after restart
+func LoadJwtKeys(config JwtConfig) (*JwtKeySet, error) {
+
+	keySet := &JwtKeySet{issuer: config.Issuer, audience: config.Audience, keys: map[string]*jwtKey{}}
+
+	if len(config.Keys) == 0 {
+		if !config.EphemeralKey {
+			return nil, ErrNoJwtKeys
+		}
+
+		log.Printf("WARNING: no jwt keys configured, using ephemeral key. Tokens are invalidated on restart")
+
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		keySet.active = &jwtKey{id: "ephemeral", method: signingMethodEdDSA, signKey: privateKey, verifyKey: publicKey}
+		keySet.keys[keySet.active.id] = keySet.active
+		return keySet, nil
+	}
+
+	for _, keyConfig := range config.Keys {
+		key, err := loadJwtKey(keyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %q: %v", keyConfig.Id, err)
+		}
+
+		if _, exists := keySet.keys[key.id]; exists {
+			return nil, fmt.Errorf("jwt key %q: duplicated kid", key.id)
+		}
+
+		keySet.keys[key.id] = key
+	}
+
+	activeKey := config.ActiveKey
+	if activeKey == "" {
+		activeKey = config.Keys[0].Id
+	}
+
+	keySet.active = keySet.keys[activeKey]
+	if keySet.active == nil || keySet.active.publicOnly {
+		return nil, fmt.Errorf("jwt key %q: active key must exist and have private key", activeKey)
+	}
+
+	return keySet, nil
+}
+
+func loadJwtKey(config JwtKeyConfig) (*jwtKey, error) {
+
+	if config.Id == "" {
+		return nil, ErrBadJwtKey
+	}
+
+	key := &jwtKey{id: config.Id}
+
+	switch config.Algorithm {
+	case AlgHS256:
+		secret := []byte(config.Secret)
+		if config.SecretFile != "" {
+			fileContent, err := ioutil.ReadFile(config.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+
+			secret = []byte(strings.TrimSpace(string(fileContent)))
+		}
+
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("HS256 secret must be at least 32 bytes")
+		}
+
+		key.method = jwt.SigningMethodHS256
+		key.signKey = secret
+		key.verifyKey = secret
+	case AlgRS256, AlgEdDSA:
+		if config.Algorithm == AlgRS256 {
+			key.method = jwt.SigningMethodRS256
+		} else {
+			key.method = signingMethodEdDSA
+		}
+
+		if config.PrivateKeyFile != "" {
+			privateKey, err := readPemKey(config.PrivateKeyFile, true)
+			if err != nil {
+				return nil, err
+			}
+
+			key.signKey = privateKey
+			switch k := privateKey.(type) {
+			case *rsa.PrivateKey:
+				key.verifyKey = &k.PublicKey
+			case ed25519.PrivateKey:
+				key.verifyKey = k.Public()
+			}
+		} else if config.PublicKeyFile != "" {
+			publicKey, err := readPemKey(config.PublicKeyFile, false)
+			if err != nil {
+				return nil, err
+			}
+
+			key.verifyKey = publicKey
+			key.publicOnly = true
+		} else {
+			return nil, fmt.Errorf("private_key_file or public_key_file is required")
+		}
+
+		_, isRsa := key.verifyKey.(*rsa.PublicKey)
+		_, isEd25519 := key.verifyKey.(ed25519.PublicKey)
+		if (config.Algorithm == AlgRS256 && !isRsa) || (config.Algorithm == AlgEdDSA && !isEd25519) {
+			return nil, fmt.Errorf("key type doesn't match algorithm %s", config.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", config.Algorithm)
+	}
+
+	return key, nil
+}
+
+func readPemKey(fileName string, private bool) (interface{}, error) {
+
+	fileContent, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(fileContent)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", fileName)
+	}
+
+	if !private {
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+//Sign fills issuer and audience of claims and signs them with active key
+func (keySet *JwtKeySet) Sign(claims *AccessClaims) (string, error) {
+
+	claims.Issuer = keySet.issuer
+	claims.Audience = keySet.audience
+
+	token := jwt.NewWithClaims(keySet.active.method, claims)
+	token.Header["kid"] = keySet.active.id
+
+	return token.SignedString(keySet.active.signKey)
+}
+
+//Parse verifies signature by key from kid header, expiration, issuer and audience of token
+func (keySet *JwtKeySet) Parse(tokenString string) (*AccessClaims, error) {
+
+	claims := &AccessClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := keySet.keys[kid]
+		if key == nil {
+			return nil, fmt.Errorf("Unknown jwt key %q", kid)
+		}
+
+		//algorithm is fixed by key, so token can't switch verification to other one
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+		}
+
+		return key.verifyKey, nil
+	})
+
+	if err != nil || !token.Valid {
+		return nil, ErrUnauthoriazedAccess
+	}
+
+	if !claims.VerifyIssuer(keySet.issuer, true) || !claims.VerifyAudience(keySet.audience, true) {
+		return nil, ErrUnauthoriazedAccess
+	}
+
+	return claims, nil
+}
+
+//Jwks returns public keys for verification of tokens by other services, HS256 keys are secret and never published
+func (keySet *JwtKeySet) Jwks() *JwkSet {
+
+	result := &JwkSet{Keys: []Jwk{}}
+	for _, key := range keySet.keys {
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			result.Keys = append(result.Keys, Jwk{
+				KeyType:   "RSA",
+				KeyId:     key.id,
+				Algorithm: AlgRS256,
+				Use:       "sig",
+				N:         base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+				E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			result.Keys = append(result.Keys, Jwk{
+				KeyType:   "OKP",
+				KeyId:     key.id,
+				Algorithm: AlgEdDSA,
+				Use:       "sig",
+				Curve:     "Ed25519",
+				X:         base64.RawURLEncoding.EncodeToString(publicKey),
+			})
+		}
+	}
+
+	sort.Slice(result.Keys, func(i, j int) bool { return result.Keys[i].KeyId < result.Keys[j].KeyId })
+	return result
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//loginFailuresWindow is how long failed sign in attempts are remembered after the last one
+const loginFailuresWindow = 15 * time.Minute
+
+//failures before each further attempt for the same account is delayed, delay doubles with every failure
+const (
+	loginDelayAfterFailures = 3
+	loginMaxDelay           = time.Minute
+)
+
+//accountLockoutFailures locks account for accountLockoutDuration, owner is notified by mail
+const (
+	accountLockoutFailures = 10
+	accountLockoutDuration = 15 * time.Minute
+)
+
+//ipLockoutFailures is higher than account limit because many users may share address
+const (
+	ipLockoutFailures = 50
+	ipLockoutDuration = 15 * time.Minute
+)
+
+//passwordResetsPerIp limits reset requests from one address within passwordResetsWindow,
+//so address can't mail many accounts. Each account is limited by profile service as well
+const (
+	passwordResetsPerIp  = 10
+	passwordResetsWindow = 15 * time.Minute
+)
+
+//LoginGuardService counts sign in attempts per account and per client address.
+//Accounts are keyed by email as entered, so unknown emails are limited the same way as existing ones
+type LoginGuardService struct {
+	storage *MongoDbStorage
+}
+
+func accountAttemptsKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptsKey(ip string) string {
+	return "ip:" + ip
+}
+
+func ipPasswordResetsKey(ip string) string {
+	return "reset_ip:" + ip
+}
+
+//loginDelay returns pause required between attempts after given number of failures
+func loginDelay(failures int) time.Duration {
+
+	if failures < loginDelayAfterFailures {
+		return 0
+	}
+
+	delay := time.Second
+	for i := loginDelayAfterFailures; i < failures && delay < loginMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > loginMaxDelay {
+		delay = loginMaxDelay
+	}
+
+	return delay
+}
+
+func (service *LoginGuardService) attempts() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("login_attempts")
+}
+
+func (service *LoginGuardService) EnsureIndexes() error {
+	return service.attempts().EnsureIndex(mgo.Index{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true})
+}
+
+//reserveContention is how many times reservation is retried when record is changed by parallel attempt
+const reserveContention = 5
+
+//Reserve counts sign in attempt of account and address before credentials are checked, so parallel
+//attempts can't pass the same check. ErrTooManyAttempts and time to wait are returned without counting
+//attempt when account or address is locked or must wait. accountLocked is true only for attempt which
+//locked account, so notification is sent once per lockout. Successful attempt is released by RegisterSuccess
+func (service *LoginGuardService) Reserve(email string, ip string) (retryAfter time.Duration, accountLocked bool, err error) {
+
+	retryAfter, _, err = service.reserve(ipAttemptsKey(ip), ipLockoutFailures, ipLockoutDuration, nil)
+	if err != nil {
+		return retryAfter, false, err
+	}
+
+	retryAfter, accountLocked, err = service.reserve(accountAttemptsKey(email), accountLockoutFailures, accountLockoutDuration, loginDelay)
+	if err != nil {
+		service.release(ipAttemptsKey(ip))
+		return retryAfter, false, err
+	}
+
+	return 0, accountLocked, nil
+}
+
+//reserve increments attempts of key when they were not changed since read, delay gives pause before next attempt
+func (service *LoginGuardService) reserve(key string, lockoutFailures int, lockoutDuration time.Duration, delay func(int) time.Duration) (time.Duration, bool, error) {
+
+	for i := 0; i < reserveContention; i++ {
+
+		now := time.Now()
+		record := LoginAttempts{}
+
+		err := service.attempts().FindId(key).One(&record)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, false, ErrStorageError
+		}
+
+		if wait := record.NextAttemptAt.Sub(now); wait > 0 {
+			return wait, false, ErrTooManyAttempts
+		}
+
+		failures := record.Failures + 1
+		nextAttemptAt := now
+		if delay != nil {
+			nextAttemptAt = now.Add(delay(failures))
+		}
+
+		locked := failures%lockoutFailures == 0
+		if locked {
+			nextAttemptAt = now.Add(lockoutDuration)
+		}
+
+		update := LoginAttempts{Key: key, Failures: failures, NextAttemptAt: nextAttemptAt, ExpireAt: nextAttemptAt.Add(loginFailuresWindow)}
+		if err == mgo.ErrNotFound {
+			err = service.attempts().Insert(&update)
+		} else {
+			err = service.attempts().Update(bson.M{"_id": key, "failures": record.Failures}, &update)
+		}
+
+		//record was changed by parallel attempt, it's read again
+		if mgo.IsDup(err) || err == mgo.ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return 0, false, ErrStorageError
+		}
+
+		return 0, locked, nil
+	}
+
+	return time.Second, false, ErrTooManyAttempts
+}
+
+//release returns reserved attempt of address, lockout set by it is kept
+func (service *LoginGuardService) release(key string) {
+
+	if err := service.attempts().UpdateId(key, bson.M{"$inc": bson.M{"failures": -1}}); err != nil && err != mgo.ErrNotFound {
+		log.Printf("Failed to release sign in attempt: %v", err)
+	}
+}
+
+//ReservePasswordReset counts reset request from address. ErrTooManyResetRequests and time to wait
+//are returned when address made too many requests in current window
+func (service *LoginGuardService) ReservePasswordReset(ip string) (time.Duration, error) {
+
+	now := time.Now()
+	record := LoginAttempts{}
+
+	_, err := service.attempts().FindId(ipPasswordResetsKey(ip)).Apply(mgo.Change{
+		Update: bson.M{
+			"$inc":         bson.M{"failures": 1},
+			"$setOnInsert": bson.M{"expire_at": now.Add(passwordResetsWindow)},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &record)
+
+	if err != nil {
+		return 0, ErrStorageError
+	}
+
+	if record.Failures <= passwordResetsPerIp {
+		return 0, nil
+	}
+
+	//expired record may live until mongo removes it
+	retryAfter := record.ExpireAt.Sub(now)
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+
+	return retryAfter, ErrTooManyResetRequests
+}
+
+//RegisterSuccess resets attempts of account and releases attempt of address. Other attempts
+//of address are kept, successful sign in to one account shouldn't allow guessing passwords of others
+func (service *LoginGuardService) RegisterSuccess(email string, ip string) error {
+
+	service.release(ipAttemptsKey(ip))
+
+	if err := service.attempts().RemoveId(accountAttemptsKey(email)); err != nil && err != mgo.ErrNotFound {
+		return ErrStorageError
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	pb "github.com/RustamSafiulin/TimeTrackerService/mail_service/api"
+)
+
+//mailRequestTimeout limits call of mail service, mail itself is delivered asynchronously
+const mailRequestTimeout = 15 * time.Second
+
+//sendTemplateMail queues mail rendered from mail service template. Mails with
+//the same idempotency key are queued once, so retried requests don't duplicate mail
+func sendTemplateMail(mailClient pb.MailServiceClient, to string, templateName string, vars map[string]string, idempotencyKey string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), mailRequestTimeout)
+	defer cancel()
+
+	response, err := mailClient.SendMail(ctx, &pb.SendMailRequest{
+		To:             []string{to},
+		TemplateName:   templateName,
+		TemplateVars:   vars,
+		IdempotencyKey: idempotencyKey,
+	})
+
+	if err != nil {
+		log.Printf("Failed to call mail service: %v", err)
+		return ErrSendMail
+	}
+
+	if response.SendStatus != pb.SendMailStatus_MailQueuedSuccess {
+		log.Printf("Mail service rejected %s mail: %s", templateName, response.Reason)
+		return ErrSendMail
+	}
+
+	return nil
+}
+
+func verificationMailVars(config *Config, profile *Profile, token string) map[string]string {
+	return map[string]string{
+		"username":   profile.UserName,
+		"verify_url": config.PublicUrl + "/api/v1/verify_email?token=" + token,
+		"expires_in": strconv.Itoa(int(emailVerificationTtl / time.Hour)),
+	}
+}
+
+//sendVerificationMail issues verification token for profile email and sends link to it
+func sendVerificationMail(config *Config, profileService *ProfileService, mailClient pb.MailServiceClient, profile *Profile) error {
+
+	token, err := profileService.CreateEmailVerification(profile.Id, profile.Email)
+	if err != nil {
+		return err
+	}
+
+	return sendTemplateMail(mailClient, profile.Email, "verify_email", verificationMailVars(config, profile, token), "verify_email:"+hashToken(token))
+}
+
+//sendAccountLockedMail notifies owner of email, if it is registered, that account is locked after failed sign in attempts
+func sendAccountLockedMail(config *Config, profileService *ProfileService, mailClient pb.MailServiceClient, email string, ip string) error {
+
+	profile, err := profileService.GetProfileByEmail(email)
+	if err == ErrProfileDoesntExist {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	vars := map[string]string{
+		"username":   profile.UserName,
+		"ip":         ip,
+		"locked_for": strconv.Itoa(int(accountLockoutDuration / time.Minute)),
+		"reset_url":  config.PublicUrl + "/reset_password",
+	}
+
+	idempotencyKey := "account_locked:" + profile.Id.Hex() + ":" + strconv.FormatInt(time.Now().Unix()/int64(accountLockoutDuration/time.Second), 10)
+	return sendTemplateMail(mailClient, profile.Email, "account_locked", vars, idempotencyKey)
+}
+
+//sendWorkspaceInviteMail sends invitation link, repeated invitation of the same email is sent again
+func sendWorkspaceInviteMail(config *Config, mailClient pb.MailServiceClient, workspace *Workspace, inviter *Profile, invite *WorkspaceInvite, token string) error {
+
+	vars := map[string]string{
+		"workspace":  workspace.Name,
+		"inviter":    inviter.UserName,
+		"role":       invite.Role,
+		"accept_url": config.PublicUrl + "/accept_invite?token=" + token,
+		"expires_in": strconv.Itoa(int(workspaceInviteTtl / (24 * time.Hour))),
+	}
+
+	if vars["inviter"] == "" {
+		vars["inviter"] = inviter.Email
+	}
+
+	return sendTemplateMail(mailClient, invite.Email, "workspace_invite", vars, "workspace_invite:"+hashToken(token))
+}
@@ -1,9 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	pb "github.com/RustamSafiulin/TimeTrackerService/mail_service/api"
+	"google.golang.org/grpc"
 )
 
 /*
@@ -19,6 +29,19 @@ const (
 type Config struct {
 	DbName   string `json:"db_name"`
 	MongoUrl string `json:"mongodb_url"`
+	//PublicUrl is address of web application used in links sent by mail
+	PublicUrl string `json:"public_url"`
+	//UnverifiedRestrictions are features unavailable until profile email is verified:
+	//export, import, calendar, invites
+	UnverifiedRestrictions []string `json:"unverified_restrictions"`
+	//ShutdownTimeout is how long in-flight requests are waited for on stop, in seconds
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	//Jwt configures signing keys of access tokens
+	Jwt JwtConfig `json:"jwt"`
+	//TrustProxyHeaders takes client address from X-Forwarded-For, enable only behind reverse proxy
+	TrustProxyHeaders bool `json:"trust_proxy_headers"`
+	//Oidc configures single sign-on, it is disabled without issuer
+	Oidc OidcConfig `json:"oidc"`
 }
 
 func ReadConfiguration() *Config {
@@ -36,13 +59,94 @@ func ReadConfiguration() *Config {
 		panic(err.Error())
 	}
 
+	if config.PublicUrl == "" {
+		config.PublicUrl = "http://localhost:3000"
+	}
+
+	if config.UnverifiedRestrictions == nil {
+		config.UnverifiedRestrictions = []string{FeatureExport, FeatureImport, FeatureCalendar, FeatureInvites}
+	}
+
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = 20
+	}
+
+	if config.Jwt.Issuer == "" {
+		config.Jwt.Issuer = config.PublicUrl
+	}
+
+	if config.Jwt.Audience == "" {
+		config.Jwt.Audience = "time_tracker_api"
+	}
+
+	if config.Oidc.RedirectUrl == "" {
+		config.Oidc.RedirectUrl = config.PublicUrl + "/api/v1/oidc/callback"
+	}
+
+	if config.Oidc.PostLoginUrl == "" {
+		config.Oidc.PostLoginUrl = config.PublicUrl + "/"
+	}
+
+	if len(config.Oidc.Scopes) == 0 {
+		config.Oidc.Scopes = []string{"openid", "email", "profile"}
+	}
+
 	return &config
 }
 
+//listenAddress follows martini's Run, which takes address from HOST and PORT variables
+func listenAddress() string {
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+
+	return net.JoinHostPort(os.Getenv("HOST"), port)
+}
+
 func main() {
 
 	config := ReadConfiguration()
 
-	api := InitializeApi(config)
-	api.Run()
+	grpcConn, err := grpc.Dial("mail_service_container:3001", grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("grpc dial failed: %v", err)
+	}
+
+	keys, err := LoadJwtKeys(config.Jwt)
+	if err != nil {
+		log.Fatalf("Failed to load jwt keys: %v", err)
+	}
+
+	storage := NewMongoStorage(config.MongoUrl, config.DbName)
+
+	api := InitializeApi(config, storage, keys, pb.NewMailServiceClient(grpcConn))
+	httpServer := &http.Server{Addr: listenAddress(), Handler: api}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %v, waiting for in-flight requests", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout)*time.Second)
+		defer cancel()
+
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Printf("Failed to finish in-flight requests: %v", err)
+		}
+
+		close(stopped)
+	}()
+
+	log.Printf("listening on %s", httpServer.Addr)
+	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+
+	<-stopped
+	grpcConn.Close()
+	storage.Close()
 }
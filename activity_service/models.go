@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"time"
 
 	"gopkg.in/mgo.v2/bson"
 )
@@ -16,6 +17,35 @@ var (
 	ErrUnauthoriazedAccess      = errors.New("Unauthorized access")
 	ErrCreateJwtToken           = errors.New("Error creation authorization token")
 	ErrParseAuthorizationHeader = errors.New("Error during parse authorization http header")
+	ErrIllegalStateTransition   = errors.New("Illegal activity state transition")
+	ErrBadQueryParams           = errors.New("Bad request query parameters")
+	ErrInvalidResetToken        = errors.New("Password reset token is invalid or expired")
+	ErrWeakPassword             = errors.New("Password must be at least 8 characters long")
+	ErrSendMail                 = errors.New("Failed to send mail")
+	ErrBadEmail                 = errors.New("Bad email address")
+	ErrInvalidVerifyToken       = errors.New("Email verification token is invalid or expired")
+	ErrEmailNotVerified         = errors.New("Email is not verified, feature is unavailable")
+	ErrForbidden                = errors.New("Access denied")
+	ErrRefreshTokenReused       = errors.New("Refresh token was already used, session is revoked")
+	ErrTwoFactorEnabled         = errors.New("Two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled      = errors.New("Two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolling    = errors.New("Two-factor enrollment is not started")
+	ErrInvalidTwoFactorCode     = errors.New("Invalid two-factor authentication code")
+	ErrInvalidChallenge         = errors.New("Sign in challenge is invalid or expired, sign in again")
+	ErrInvalidCredentials       = errors.New("Invalid email or password")
+	ErrTooManyAttempts          = errors.New("Too many failed sign in attempts, try again later")
+	ErrTooManyResetRequests     = errors.New("Too many password reset requests, try again later")
+	ErrOidcDisabled             = errors.New("Single sign-on is not configured")
+	ErrOidcProvider             = errors.New("Identity provider is unavailable")
+	ErrOidcState                = errors.New("Single sign-on login is invalid or expired, sign in again")
+	ErrOidcCodeExchange         = errors.New("Identity provider rejected authorization code")
+	ErrOidcIdToken              = errors.New("Identity provider returned invalid id token")
+	ErrOidcEmailNotVerified     = errors.New("Identity provider didn't confirm email of account")
+	ErrBadScope                 = errors.New("Unknown token scope, allowed are activities:read, activities:write, reports:read")
+	ErrTooManyApiTokens         = errors.New("Too many api tokens, revoke unused ones")
+	ErrBadRole                  = errors.New("Unknown role, allowed are owner, admin, member, viewer")
+	ErrInvalidInvite            = errors.New("Invitation is invalid or expired")
+	ErrInviteEmailMismatch      = errors.New("Invitation was sent to other email, sign in with verified invited email")
 )
 
 type ErrorMsg struct {
@@ -23,7 +53,7 @@ type ErrorMsg struct {
 }
 
 type SuccessMsg struct {
-	Msg string `json: "msg"`
+	Msg string `json:"msg"`
 }
 
 //collections
@@ -33,6 +63,62 @@ type Profile struct {
 	Email    string        `json:"email,omitempty" bson:"email,omitempty"`
 	UserName string        `json:"username,omitempty" bson:"username,omitempty"`
 	Password string        `json:"password,omitempty" bson:"password,omitempty"`
+	//EmailVerified is stored explicitly, profiles created before verification was introduced are verified on start
+	EmailVerified bool `json:"email_verified" bson:"email_verified"`
+}
+
+//features which are unavailable until email is verified, see Config.UnverifiedRestrictions
+const (
+	FeatureExport   = "export"
+	FeatureImport   = "import"
+	FeatureCalendar = "calendar"
+	FeatureInvites  = "invites"
+)
+
+type EmailVerification struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	ProfileId bson.ObjectId `bson:"profile_id"`
+	//Email is address being verified, it becomes profile email on confirmation
+	Email     string    `bson:"email"`
+	TokenHash string    `bson:"token_hash"`
+	CreatedAt int64     `bson:"created_at"`
+	ExpireAt  time.Time `bson:"expire_at"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetToken struct {
+	Id        bson.ObjectId `bson:"_id,omitempty"`
+	ProfileId bson.ObjectId `bson:"profile_id"`
+	TokenHash string        `bson:"token_hash"`
+	CreatedAt int64         `bson:"created_at"`
+	ExpireAt  time.Time     `bson:"expire_at"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+//ProfileUpdate is partial update of profile, omitted fields are kept.
+//New password requires current one, new email is applied after confirmation
+type ProfileUpdate struct {
+	UserName        *string `json:"username"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+type ProfileUpdateResult struct {
+	Profile *Profile `json:"profile"`
+	//PendingEmail is new email waiting for confirmation
+	PendingEmail string `json:"pending_email,omitempty"`
 }
 
 type Avatar struct {
@@ -47,6 +133,13 @@ type UserInfo struct {
 }
 
 //activity
+const (
+	ActivityCreated = "created"
+	ActivityRunning = "running"
+	ActivityPaused  = "paused"
+	ActivityStopped = "stopped"
+)
+
 type WorkInterval struct {
 	Start int64 `json:"begin" bson:"begin"`
 	Stop  int64 `json:"end" bson:"end"`
@@ -57,12 +150,156 @@ type Activity struct {
 	ProfileId        bson.ObjectId  `json:"profile_id,omitempty" bson:"profile_id,omitempty"`
 	CreatedAt        int64          `json:"created_at,omitempty" bson:"created_at,omitempty"`
 	IsStarted        bool           `json:"is_started,omitempty" bson:"is_started,omitempty"`
+	Status           string         `json:"status,omitempty" bson:"status,omitempty"`
 	Description      string         `json:"description,omitempty" bson:"description,omitempty"`
 	Category         string         `json:"category,omitempty" bson:"category,omitempty"`
 	BeginTime        int64          `json:"begin_time,omitempty" bson:"begin_time,omitempty"`
 	PlannedBeginTime int64          `json:"planned_begin_time,omitempty" bson:"planned_begin_time,omitempty"`
 	ActualDuration   uint64         `json:"actual_duration,omitempty" bson:"actual_duration,omitempty"`
 	WorkIntervals    []WorkInterval `json:"work_intervals,omitempty" bson:"work_intervals,omitempty"`
+	ExternalId       string         `json:"external_id,omitempty" bson:"external_id,omitempty"`
+	//WorkspaceId is set for activities shared with workspace, admins of workspace can read them
+	WorkspaceId bson.ObjectId `json:"workspace_id,omitempty" bson:"workspace_id,omitempty"`
+}
+
+//CurrentStatus returns timer state of activity. Activities stored before
+//status field was introduced get state derived from is_started and intervals
+func (a *Activity) CurrentStatus() string {
+	if a.Status != "" {
+		return a.Status
+	}
+
+	if a.IsStarted {
+		return ActivityRunning
+	}
+
+	if len(a.WorkIntervals) > 0 {
+		return ActivityPaused
+	}
+
+	return ActivityCreated
+}
+
+//Elapsed returns tracked time of activity including running interval
+func (a *Activity) Elapsed(now int64) int64 {
+	elapsed := int64(a.ActualDuration)
+	if openInterval := a.OpenInterval(); openInterval != nil && now > openInterval.Start {
+		elapsed += now - openInterval.Start
+	}
+
+	return elapsed
+}
+
+//OpenInterval returns work interval which is not closed yet
+func (a *Activity) OpenInterval() *WorkInterval {
+	for i := range a.WorkIntervals {
+		if a.WorkIntervals[i].Stop == 0 {
+			return &a.WorkIntervals[i]
+		}
+	}
+
+	return nil
+}
+
+//ActivityFilter restricts activities listing. Zero values mean no restriction
+type ActivityFilter struct {
+	From        int64
+	To          int64
+	Category    string
+	IsStarted   *bool
+	Text        string
+	WorkspaceId string
+}
+
+//PageRequest describes requested page of activities listing
+type PageRequest struct {
+	Limit      int
+	Cursor     string
+	SortField  string
+	Descending bool
+}
+
+type ActivityPage struct {
+	Items      []Activity `json:"items"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	Total      int        `json:"total"`
+}
+
+//reports
+const (
+	ReportPeriodDay   = "day"
+	ReportPeriodWeek  = "week"
+	ReportPeriodMonth = "month"
+
+	ReportGroupByCategory = "category"
+	ReportGroupByDay      = "day"
+)
+
+type ReportRequest struct {
+	Period      string
+	GroupBy     string
+	From        int64
+	To          int64
+	Location    *time.Location
+	WorkspaceId string
+}
+
+type ReportGroup struct {
+	Key      string `json:"key"`
+	Duration int64  `json:"duration"`
+}
+
+type ReportBucket struct {
+	Start  int64         `json:"start"`
+	End    int64         `json:"end"`
+	Total  int64         `json:"total"`
+	Groups []ReportGroup `json:"groups"`
+}
+
+type Report struct {
+	Period   string         `json:"period"`
+	GroupBy  string         `json:"group_by"`
+	Timezone string         `json:"timezone"`
+	From     int64          `json:"from"`
+	To       int64          `json:"to"`
+	Total    int64          `json:"total"`
+	Buckets  []ReportBucket `json:"buckets"`
+}
+
+//ExportedInterval is single work interval of activity in export
+type ExportedInterval struct {
+	Description string       `bson:"description"`
+	Category    string       `bson:"category"`
+	Interval    WorkInterval `bson:"work_intervals"`
+}
+
+//ImportRow is time entry read from imported file
+type ImportRow struct {
+	Row         int
+	ExternalId  string
+	Description string
+	Category    string
+	Start       int64
+	End         int64
+	Err         error
+}
+
+type ImportRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type ImportResult struct {
+	DryRun     bool             `json:"dry_run"`
+	Total      int              `json:"total"`
+	Imported   int              `json:"imported"`
+	Duplicates int              `json:"duplicates"`
+	Errors     []ImportRowError `json:"errors"`
+}
+
+type CurrentActivity struct {
+	Activity *Activity `json:"activity"`
+	Elapsed  int64     `json:"elapsed"`
 }
 
 //settings
@@ -86,9 +323,219 @@ type Notification struct {
 	CreatedAt   int64         `json:"created_at,omitempty" bson:"created_at,omitempty"`
 }
 
+//calendar tokens
+type CalendarToken struct {
+	Id        bson.ObjectId `json:"-" bson:"_id,omitempty"`
+	ProfileId bson.ObjectId `json:"profile_id" bson:"profile_id"`
+	TokenHash string        `json:"-" bson:"token_hash"`
+	CreatedAt int64         `json:"created_at" bson:"created_at"`
+}
+
+type CalendarTokenInfo struct {
+	Token   string `json:"token"`
+	FeedUrl string `json:"feed_url"`
+}
+
 //sessions
 type SessionInfo struct {
-	Id        bson.ObjectId `json:"-" bson:"_id"`
-	ProfileId bson.ObjectId `json:"profile_id" bson:"profile_id"`
-	SessionId string        `json:"session_id" bson:"session_id"`
+	Id         bson.ObjectId `json:"id" bson:"_id"`
+	ProfileId  bson.ObjectId `json:"profile_id" bson:"profile_id"`
+	Device     string        `json:"device" bson:"device"`
+	Ip         string        `json:"ip" bson:"ip"`
+	UserAgent  string        `json:"user_agent" bson:"user_agent"`
+	CreatedAt  int64         `json:"created_at" bson:"created_at"`
+	LastSeenAt int64         `json:"last_seen_at" bson:"last_seen_at"`
+	//Current marks session of caller in sessions list
+	Current bool `json:"current" bson:"-"`
+
+	RefreshTokenHash  string    `json:"-" bson:"refresh_token_hash"`
+	UsedRefreshHashes []string  `json:"-" bson:"used_refresh_hashes"`
+	ExpireAt          time.Time `json:"-" bson:"expire_at"`
+}
+
+type ClientInfo struct {
+	Device    string
+	Ip        string
+	UserAgent string
+}
+
+type SignInRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	//Device is name of client device shown in sessions list
+	Device string `json:"device"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+//SessionTokens are issued on sign in and refresh. Access token is short-lived jwt,
+//refresh token is single-use and is exchanged for new pair when access token expires
+type SessionTokens struct {
+	ProfileId    bson.ObjectId `json:"profile_id"`
+	SessionId    string        `json:"session_id"`
+	AccessToken  string        `json:"access_token"`
+	RefreshToken string        `json:"refresh_token"`
+	ExpiresIn    int64         `json:"expires_in"`
+}
+
+//TwoFactorState is stored per profile, id is profile id. PendingSecret is kept
+//until enrollment is confirmed, RecoveryCodes are hashes of unused recovery codes
+type TwoFactorState struct {
+	ProfileId     bson.ObjectId `bson:"_id"`
+	Enabled       bool          `bson:"enabled"`
+	Secret        string        `bson:"secret,omitempty"`
+	PendingSecret string        `bson:"pending_secret,omitempty"`
+	RecoveryCodes []string      `bson:"recovery_codes,omitempty"`
+	LastStep      int64         `bson:"last_step,omitempty"`
+	EnabledAt     int64         `bson:"enabled_at,omitempty"`
+}
+
+//LoginChallenge links first step of sign in with two-factor code
+type LoginChallenge struct {
+	Id        bson.ObjectId `bson:"_id"`
+	ProfileId bson.ObjectId `bson:"profile_id"`
+	Email     string        `bson:"email"`
+	TokenHash string        `bson:"token_hash"`
+	Device    string        `bson:"device"`
+	Attempts  int           `bson:"attempts"`
+	ExpireAt  time.Time     `bson:"expire_at"`
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	//ProvisioningUri is otpauth uri, client shows it as QR code for authenticator application
+	ProvisioningUri string `json:"provisioning_uri"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+//TwoFactorRequired is returned by sign in instead of tokens when two-factor authentication is enabled
+type TwoFactorRequired struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int64  `json:"expires_in"`
+}
+
+type TwoFactorSignInRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+}
+
+//LoginAttempts counts sign in attempts of account or client address, Key is prefixed with its kind.
+//For password reset requests of client address Failures is number of requests
+type LoginAttempts struct {
+	Key           string    `bson:"_id"`
+	Failures      int       `bson:"failures"`
+	NextAttemptAt time.Time `bson:"next_attempt_at,omitempty"`
+	ExpireAt      time.Time `bson:"expire_at"`
+}
+
+//OidcLoginState is kept between redirect to identity provider and callback, id is hash of state parameter
+type OidcLoginState struct {
+	StateHash    string    `bson:"_id"`
+	Nonce        string    `bson:"nonce"`
+	CodeVerifier string    `bson:"code_verifier"`
+	Device       string    `bson:"device"`
+	ExpireAt     time.Time `bson:"expire_at"`
+}
+
+//OidcIdentityLink links subject of identity provider to profile
+type OidcIdentityLink struct {
+	Id        bson.ObjectId `bson:"_id"`
+	Issuer    string        `bson:"issuer"`
+	Subject   string        `bson:"subject"`
+	ProfileId bson.ObjectId `bson:"profile_id"`
+	Email     string        `bson:"email"`
+	LinkedAt  int64         `bson:"linked_at"`
+}
+
+//ApiToken is personal access token, ExpiresAt is zero for tokens without expiration
+type ApiToken struct {
+	Id         bson.ObjectId `json:"id" bson:"_id"`
+	ProfileId  bson.ObjectId `json:"profile_id" bson:"profile_id"`
+	Name       string        `json:"name" bson:"name"`
+	Prefix     string        `json:"prefix" bson:"prefix"`
+	TokenHash  string        `json:"-" bson:"token_hash"`
+	Scopes     []string      `json:"scopes" bson:"scopes"`
+	CreatedAt  int64         `json:"created_at" bson:"created_at"`
+	LastUsedAt int64         `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	ExpiresAt  int64         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+type ApiTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	//ExpiresInDays is optional, token doesn't expire without it
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+//CreatedApiToken contains token itself, it is returned only on creation
+type CreatedApiToken struct {
+	ApiToken
+	Token string `json:"token"`
+}
+
+type Workspace struct {
+	Id        bson.ObjectId `json:"id" bson:"_id"`
+	Name      string        `json:"name" bson:"name"`
+	OwnerId   bson.ObjectId `json:"owner_id" bson:"owner_id"`
+	CreatedAt int64         `json:"created_at" bson:"created_at"`
+}
+
+type WorkspaceMember struct {
+	Id          bson.ObjectId `json:"-" bson:"_id"`
+	WorkspaceId bson.ObjectId `json:"workspace_id" bson:"workspace_id"`
+	ProfileId   bson.ObjectId `json:"profile_id" bson:"profile_id"`
+	Role        string        `json:"role" bson:"role"`
+	JoinedAt    int64         `json:"joined_at" bson:"joined_at"`
+}
+
+//WorkspaceMembership is workspace with role of caller in it
+type WorkspaceMembership struct {
+	Workspace
+	Role string `json:"role"`
+}
+
+type WorkspaceMemberInfo struct {
+	ProfileId bson.ObjectId `json:"profile_id"`
+	Email     string        `json:"email"`
+	UserName  string        `json:"username"`
+	Role      string        `json:"role"`
+	JoinedAt  int64         `json:"joined_at"`
+}
+
+type WorkspaceInvite struct {
+	Id          bson.ObjectId `json:"id" bson:"_id"`
+	WorkspaceId bson.ObjectId `json:"workspace_id" bson:"workspace_id"`
+	Email       string        `json:"email" bson:"email"`
+	Role        string        `json:"role" bson:"role"`
+	TokenHash   string        `json:"-" bson:"token_hash"`
+	InvitedBy   bson.ObjectId `json:"invited_by" bson:"invited_by"`
+	CreatedAt   int64         `json:"created_at" bson:"created_at"`
+	ExpireAt    time.Time     `json:"-" bson:"expire_at"`
+}
+
+type WorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type WorkspaceInviteRequest struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type WorkspaceRoleRequest struct {
+	Role string `json:"role"`
+}
+
+type AcceptInviteRequest struct {
+	Token string `json:"token"`
 }
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//oidcStateTtl is how long user may stay on identity provider pages before returning with code
+const oidcStateTtl = 10 * time.Minute
+
+//oidcKeysRefreshInterval limits refetching of provider keys when token has unknown kid
+const oidcKeysRefreshInterval = time.Minute
+
+//oidcStateCookie binds login started in browser to callback in the same browser
+const oidcStateCookie = "oidc_state"
+
+const oidcRequestTimeout = 10 * time.Second
+
+//OidcConfig enables single sign-on when issuer is set. Provider endpoints are discovered
+//from issuer, plain http issuer is accepted, so login can be tested against local mock provider
+type OidcConfig struct {
+	Issuer       string   `json:"issuer"`
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectUrl  string   `json:"redirect_url"`
+	Scopes       []string `json:"scopes"`
+	//PostLoginUrl is page of web application which receives tokens in url fragment
+	PostLoginUrl string `json:"post_login_url"`
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IdToken string `json:"id_token"`
+	Error   string `json:"error"`
+}
+
+//OidcIdentity is identity of user confirmed by provider id token
+type OidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+//OidcService implements authorization code flow with PKCE, profiles are linked
+//to provider subject on first login by verified email or created
+type OidcService struct {
+	storage    *MongoDbStorage
+	config     OidcConfig
+	httpClient *http.Client
+
+	mutex         sync.Mutex
+	metadata      *oidcMetadata
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+func NewOidcService(storage *MongoDbStorage, config OidcConfig) *OidcService {
+	return &OidcService{storage: storage, config: config, httpClient: &http.Client{Timeout: oidcRequestTimeout}}
+}
+
+func (service *OidcService) Enabled() bool {
+	return service.config.Issuer != "" && service.config.ClientId != ""
+}
+
+func (service *OidcService) states() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("oidc_states")
+}
+
+func (service *OidcService) identities() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("oidc_identities")
+}
+
+func (service *OidcService) EnsureIndexes() error {
+
+	if err := service.states().EnsureIndex(mgo.Index{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true}); err != nil {
+		return err
+	}
+
+	return service.identities().EnsureIndex(mgo.Index{Key: []string{"issuer", "subject"}, Unique: true, Background: true})
+}
+
+func (service *OidcService) getJson(address string, result interface{}) error {
+
+	response, err := service.httpClient.Get(address)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", address, response.Status)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+//discover loads provider metadata once, it isn't done on start so provider may start after service
+func (service *OidcService) discover() (*oidcMetadata, error) {
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	if service.metadata != nil {
+		return service.metadata, nil
+	}
+
+	metadata := &oidcMetadata{}
+	if err := service.getJson(strings.TrimSuffix(service.config.Issuer, "/")+"/.well-known/openid-configuration", metadata); err != nil {
+		log.Printf("Failed to discover oidc provider: %v", err)
+		return nil, ErrOidcProvider
+	}
+
+	if metadata.Issuer != service.config.Issuer {
+		log.Printf("Oidc provider issuer %q doesn't match configured %q", metadata.Issuer, service.config.Issuer)
+		return nil, ErrOidcProvider
+	}
+
+	service.metadata = metadata
+	return metadata, nil
+}
+
+//pkceChallenge is S256 code challenge of verifier, see RFC 7636
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+//StartLogin stores state of login and returns state and address of provider authorization page
+func (service *OidcService) StartLogin(device string) (string, string, error) {
+
+	metadata, err := service.discover()
+	if err != nil {
+		return "", "", err
+	}
+
+	state, loginState, err := newOidcLoginState(device)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := service.states().Insert(loginState); err != nil {
+		return "", "", ErrStorageError
+	}
+
+	return state, service.authorizationUrl(metadata, state, loginState), nil
+}
+
+//newOidcLoginState generates state parameter, nonce and PKCE code verifier of login
+func newOidcLoginState(device string) (string, *OidcLoginState, error) {
+
+	state, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	codeVerifier, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return state, &OidcLoginState{
+		StateHash:    hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		Device:       device,
+		ExpireAt:     time.Now().Add(oidcStateTtl),
+	}, nil
+}
+
+func (service *OidcService) authorizationUrl(metadata *oidcMetadata, state string, loginState *OidcLoginState) string {
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", service.config.ClientId)
+	query.Set("redirect_uri", service.config.RedirectUrl)
+	query.Set("scope", strings.Join(service.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", loginState.Nonce)
+	query.Set("code_challenge", pkceChallenge(loginState.CodeVerifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return metadata.AuthorizationEndpoint + separator + query.Encode()
+}
+
+//OidcCallbackParams returns state and code of callback. State must come back to the browser
+//which started login and has it in cookie, otherwise foreign login could be injected
+func OidcCallbackParams(r *http.Request) (string, string, error) {
+
+	query := r.URL.Query()
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != query.Get("state") || query.Get("code") == "" {
+		return "", "", ErrOidcState
+	}
+
+	return query.Get("state"), query.Get("code"), nil
+}
+
+//CompleteLogin exchanges authorization code and returns identity from verified id token.
+//State is removed on first use, so callback can't be replayed
+func (service *OidcService) CompleteLogin(state string, code string) (*OidcIdentity, *OidcLoginState, error) {
+
+	loginState := OidcLoginState{}
+	_, err := service.states().Find(bson.M{
+		"_id":       hashToken(state),
+		"expire_at": bson.M{"$gt": time.Now()},
+	}).Apply(mgo.Change{Remove: true}, &loginState)
+
+	if err == mgo.ErrNotFound {
+		return nil, nil, ErrOidcState
+	}
+
+	if err != nil {
+		return nil, nil, ErrStorageError
+	}
+
+	identity, err := service.exchangeCode(&loginState, code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return identity, &loginState, nil
+}
+
+//exchangeCode redeems authorization code with PKCE verifier of login and verifies returned id token
+func (service *OidcService) exchangeCode(loginState *OidcLoginState, code string) (*OidcIdentity, error) {
+
+	metadata, err := service.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", service.config.RedirectUrl)
+	form.Set("code_verifier", loginState.CodeVerifier)
+
+	//public client is identified by client_id, confidential one authenticates with client_secret_basic
+	if service.config.ClientSecret == "" {
+		form.Set("client_id", service.config.ClientId)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, ErrOidcProvider
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	if service.config.ClientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(service.config.ClientId), url.QueryEscape(service.config.ClientSecret))
+	}
+
+	response, err := service.httpClient.Do(request)
+	if err != nil {
+		log.Printf("Failed to call oidc token endpoint: %v", err)
+		return nil, ErrOidcProvider
+	}
+	defer response.Body.Close()
+
+	tokenResponse := oidcTokenResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil || response.StatusCode != http.StatusOK || tokenResponse.IdToken == "" {
+		log.Printf("Oidc token endpoint answered %s %s", response.Status, tokenResponse.Error)
+		return nil, ErrOidcCodeExchange
+	}
+
+	return service.verifyIdToken(metadata, tokenResponse.IdToken, loginState.Nonce)
+}
+
+func (service *OidcService) verifyIdToken(metadata *oidcMetadata, idToken string, nonce string) (*OidcIdentity, error) {
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return service.providerKey(metadata, kid)
+	})
+
+	if err != nil || !token.Valid {
+		log.Printf("Bad oidc id token: %v", err)
+		return nil, ErrOidcIdToken
+	}
+
+	if !claims.VerifyIssuer(metadata.Issuer, true) || !oidcAudienceValid(claims, service.config.ClientId) {
+		return nil, ErrOidcIdToken
+	}
+
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, ErrOidcIdToken
+	}
+
+	identity := &OidcIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Name == "" {
+		identity.Name, _ = claims["preferred_username"].(string)
+	}
+
+	if identity.Subject == "" {
+		return nil, ErrOidcIdToken
+	}
+
+	return identity, nil
+}
+
+//oidcAudienceValid accepts aud as string or list, jwt-go handles string only.
+//Token issued for several audiences must name client as authorized party
+func oidcAudienceValid(claims jwt.MapClaims, clientId string) bool {
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		found := false
+		for _, value := range aud {
+			if value == clientId {
+				found = true
+			}
+		}
+
+		if len(aud) > 1 {
+			azp, _ := claims["azp"].(string)
+			return found && azp == clientId
+		}
+
+		return found
+	default:
+		return false
+	}
+}
+
+//providerKey returns key of provider by kid, keys are refetched when provider rotates them
+func (service *OidcService) providerKey(metadata *oidcMetadata, kid string) (interface{}, error) {
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	if key, ok := service.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(service.keysFetchedAt) < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("Unknown oidc key %q", kid)
+	}
+
+	jwks := struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyId   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}{}
+
+	service.keysFetchedAt = time.Now()
+	if err := service.getJson(metadata.JwksUri, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+
+			keys[jwk.KeyId] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil || jwk.Curve != "P-256" {
+				continue
+			}
+
+			keys[jwk.KeyId] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	service.keys = keys
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("Unknown oidc key %q", kid)
+}
+
+//ResolveProfile returns profile linked to identity. On first login profile with the same
+//verified email is linked, or new profile without password is created
+func (service *OidcService) ResolveProfile(identity *OidcIdentity) (*Profile, error) {
+
+	dbStorage := service.storage
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+
+	link := OidcIdentityLink{}
+	err := service.identities().Find(bson.M{"issuer": service.config.Issuer, "subject": identity.Subject}).One(&link)
+	if err == nil {
+		profile := Profile{}
+		if err := profilesCollection.FindId(link.ProfileId).One(&profile); err != nil {
+			return nil, ErrStorageError
+		}
+
+		profile.Password = ""
+		return &profile, nil
+	}
+
+	if err != mgo.ErrNotFound {
+		return nil, ErrStorageError
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, ErrOidcEmailNotVerified
+	}
+
+	profile := Profile{}
+	err = profilesCollection.Find(bson.M{"email": identity.Email}).One(&profile)
+	switch err {
+	case nil:
+		//password of profile with unconfirmed email could be set by anyone who
+		//registered this email first, so it stops working and its sessions are closed
+		if !profile.EmailVerified {
+			if err := profilesCollection.UpdateId(profile.Id, bson.M{"$set": bson.M{"email_verified": true}, "$unset": bson.M{"password": ""}}); err != nil {
+				return nil, ErrStorageError
+			}
+
+			sessionCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
+			if _, err := sessionCollection.RemoveAll(bson.M{"profile_id": profile.Id}); err != nil {
+				return nil, ErrStorageError
+			}
+
+			profile.EmailVerified = true
+		}
+	case mgo.ErrNotFound:
+		profile = Profile{Id: bson.NewObjectId(), Email: identity.Email, UserName: identity.Name, EmailVerified: true}
+		if err := profilesCollection.Insert(&profile); err != nil {
+			return nil, ErrStorageError
+		}
+	default:
+		return nil, ErrStorageError
+	}
+
+	err = service.identities().Insert(&OidcIdentityLink{
+		Id:        bson.NewObjectId(),
+		Issuer:    service.config.Issuer,
+		Subject:   identity.Subject,
+		ProfileId: profile.Id,
+		Email:     identity.Email,
+		LinkedAt:  time.Now().Unix(),
+	})
+
+	if err != nil && !mgo.IsDup(err) {
+		return nil, ErrStorageError
+	}
+
+	profile.Password = ""
+	return &profile, nil
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	mockClientId     = "time_tracker"
+	mockClientSecret = "client secret"
+	mockRedirectUrl  = "http://localhost:3000/api/v1/oidc/callback"
+)
+
+//mockIdp is local identity provider serving discovery, authorization, token and jwks endpoints
+type mockIdp struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mutex sync.Mutex
+	codes map[string]mockAuthorization
+
+	//claims of next id token, iss and aud are set by provider when empty
+	email         string
+	emailVerified bool
+	issuer        string
+	audience      interface{}
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+	redirect  string
+}
+
+func newMockIdp(t *testing.T) *mockIdp {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdp{key: key, codes: map[string]mockAuthorization{}, email: "user@example.com", emailVerified: true}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	mux.HandleFunc("/jwks", idp.jwks)
+
+	idp.server = httptest.NewServer(mux)
+
+	return idp
+}
+
+func (idp *mockIdp) discovery(w http.ResponseWriter, r *http.Request) {
+
+	json.NewEncoder(w).Encode(oidcMetadata{
+		Issuer:                idp.server.URL,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JwksUri:               idp.server.URL + "/jwks",
+	})
+}
+
+//authorize signs user in immediately and redirects back with code
+func (idp *mockIdp) authorize(w http.ResponseWriter, r *http.Request) {
+
+	query := r.URL.Query()
+	if query.Get("client_id") != mockClientId || query.Get("code_challenge_method") != "S256" || query.Get("response_type") != "code" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := bson.NewObjectId().Hex()
+
+	idp.mutex.Lock()
+	idp.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce"), redirect: query.Get("redirect_uri")}
+	idp.mutex.Unlock()
+
+	http.Redirect(w, r, query.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+}
+
+func (idp *mockIdp) token(w http.ResponseWriter, r *http.Request) {
+
+	invalidGrant := func() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+	}
+
+	clientId, clientSecret, _ := r.BasicAuth()
+	if clientId != url.QueryEscape(mockClientId) || clientSecret != url.QueryEscape(mockClientSecret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mutex.Lock()
+	authorization, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mutex.Unlock()
+
+	if !ok || authorization.redirect != r.PostFormValue("redirect_uri") || pkceChallenge(r.PostFormValue("code_verifier")) != authorization.challenge {
+		invalidGrant()
+		return
+	}
+
+	issuer := idp.issuer
+	if issuer == "" {
+		issuer = idp.server.URL
+	}
+
+	audience := idp.audience
+	if audience == nil {
+		audience = mockClientId
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            issuer,
+		"aud":            audience,
+		"sub":            "subject-1",
+		"email":          idp.email,
+		"email_verified": idp.emailVerified,
+		"name":           "Mock User",
+		"nonce":          authorization.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	})
+	token.Header["kid"] = "mock-key"
+
+	idToken, err := token.SignedString(idp.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (idp *mockIdp) jwks(w http.ResponseWriter, r *http.Request) {
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "mock-key",
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func newTestOidcService(idp *mockIdp, storage *MongoDbStorage) *OidcService {
+
+	return NewOidcService(storage, OidcConfig{
+		Issuer:       idp.server.URL,
+		ClientId:     mockClientId,
+		ClientSecret: mockClientSecret,
+		RedirectUrl:  mockRedirectUrl,
+		Scopes:       []string{"openid", "email", "profile"},
+	})
+}
+
+//authorizeInBrowser follows login to provider and returns callback request with state cookie of browser
+func authorizeInBrowser(t *testing.T, authorizationUrl string, state string) *http.Request {
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	response, err := client.Get(authorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("provider answered %s to authorization request", response.Status)
+	}
+
+	callback := httptest.NewRequest(http.MethodGet, response.Header.Get("Location"), nil)
+	callback.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: state})
+
+	return callback
+}
+
+//login goes through authorization code flow without storage, login state is kept by test
+func login(t *testing.T, service *OidcService, prepare func(*OidcLoginState)) (*OidcIdentity, error) {
+
+	metadata, err := service.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, loginState, err := newOidcLoginState("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callback := authorizeInBrowser(t, service.authorizationUrl(metadata, state, loginState), state)
+
+	callbackState, code, err := OidcCallbackParams(callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hashToken(callbackState) != loginState.StateHash {
+		t.Fatal("callback returned other state")
+	}
+
+	if prepare != nil {
+		prepare(loginState)
+	}
+
+	return service.exchangeCode(loginState, code)
+}
+
+func TestOidcLogin(t *testing.T) {
+
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	service := newTestOidcService(idp, nil)
+
+	identity, err := login(t, service, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.Subject != "subject-1" || identity.Email != "user@example.com" || !identity.EmailVerified || identity.Name != "Mock User" {
+		t.Fatalf("unexpected identity %+v", identity)
+	}
+}
+
+func TestOidcCallbackStateMismatch(t *testing.T) {
+
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	service := newTestOidcService(idp, nil)
+
+	metadata, err := service.discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, loginState, err := newOidcLoginState("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//callback opened in browser which didn't start this login
+	callback := authorizeInBrowser(t, service.authorizationUrl(metadata, state, loginState), "other state")
+	if _, _, err := OidcCallbackParams(callback); err != ErrOidcState {
+		t.Fatalf("expected ErrOidcState, got %v", err)
+	}
+
+	callback.Header.Del("Cookie")
+	if _, _, err := OidcCallbackParams(callback); err != ErrOidcState {
+		t.Fatalf("expected ErrOidcState without cookie, got %v", err)
+	}
+}
+
+func TestOidcNonceMismatch(t *testing.T) {
+
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	service := newTestOidcService(idp, nil)
+
+	_, err := login(t, service, func(loginState *OidcLoginState) {
+		loginState.Nonce = "other nonce"
+	})
+
+	if err != ErrOidcIdToken {
+		t.Fatalf("expected ErrOidcIdToken, got %v", err)
+	}
+}
+
+func TestOidcBadCodeVerifier(t *testing.T) {
+
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	service := newTestOidcService(idp, nil)
+
+	_, err := login(t, service, func(loginState *OidcLoginState) {
+		loginState.CodeVerifier = "other verifier"
+	})
+
+	if err != ErrOidcCodeExchange {
+		t.Fatalf("expected ErrOidcCodeExchange, got %v", err)
+	}
+}
+
+func TestOidcWrongAudienceOrIssuer(t *testing.T) {
+
+	cases := []struct {
+		name     string
+		issuer   string
+		audience interface{}
+	}{
+		{name: "audience", audience: "other_client"},
+		{name: "audience list without azp", audience: []string{mockClientId, "other_client"}},
+		{name: "issuer", issuer: "http://other.issuer"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+
+			idp := newMockIdp(t)
+			defer idp.server.Close()
+
+			idp.issuer = c.issuer
+			idp.audience = c.audience
+
+			if _, err := login(t, newTestOidcService(idp, nil), nil); err != ErrOidcIdToken {
+				t.Fatalf("expected ErrOidcIdToken, got %v", err)
+			}
+		})
+	}
+}
+
+//TestOidcUnverifiedEmail checks that unverified email isn't linked, this part needs
+//mongo, e.g. TEST_MONGODB_URL=mongodb://localhost:27017/time_tracker_test
+func TestOidcUnverifiedEmail(t *testing.T) {
+
+	idp := newMockIdp(t)
+	defer idp.server.Close()
+	idp.email = bson.NewObjectId().Hex() + "@example.com"
+	idp.emailVerified = false
+
+	identity, err := login(t, newTestOidcService(idp, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity.EmailVerified {
+		t.Fatal("email must not be verified")
+	}
+
+	mongoUrl := os.Getenv("TEST_MONGODB_URL")
+	if mongoUrl == "" {
+		t.Skip("TEST_MONGODB_URL isn't set")
+	}
+
+	storage := NewMongoStorage(mongoUrl, "time_tracker_test")
+	defer storage.Close()
+
+	service := newTestOidcService(idp, storage)
+	if err := service.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, authorizationUrl, err := service.StartLogin("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callbackState, code, err := OidcCallbackParams(authorizeInBrowser(t, authorizationUrl, state))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, _, err = service.CompleteLogin(callbackState, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := service.ResolveProfile(identity); err != ErrOidcEmailNotVerified {
+		t.Fatalf("expected ErrOidcEmailNotVerified, got %v", err)
+	}
+
+	//state is used once
+	if _, _, err := service.CompleteLogin(callbackState, code); err != ErrOidcState {
+		t.Fatalf("expected ErrOidcState on replay, got %v", err)
+	}
+}
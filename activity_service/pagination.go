@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+)
+
+var sortableActivityFields = map[string]bool{
+	"created_at":      true,
+	"begin_time":      true,
+	"actual_duration": true,
+}
+
+//pageCursor is position of last returned item. Value is nil when
+//sort field is absent in document, such documents are sorted before any number
+type pageCursor struct {
+	Sort  string        `json:"s"`
+	Value *int64        `json:"v"`
+	Id    bson.ObjectId `json:"id"`
+}
+
+//sortKeys holds sortable fields of stored activity, used to build next cursor
+type sortKeys struct {
+	CreatedAt      *int64 `bson:"created_at"`
+	BeginTime      *int64 `bson:"begin_time"`
+	ActualDuration *int64 `bson:"actual_duration"`
+}
+
+func (k *sortKeys) value(field string) *int64 {
+	switch field {
+	case "begin_time":
+		return k.BeginTime
+	case "actual_duration":
+		return k.ActualDuration
+	default:
+		return k.CreatedAt
+	}
+}
+
+//ParsePageRequest reads limit, cursor, sort and order query parameters
+func ParsePageRequest(values url.Values) (*PageRequest, error) {
+
+	page := &PageRequest{
+		Limit:      defaultPageLimit,
+		Cursor:     values.Get("cursor"),
+		SortField:  "created_at",
+		Descending: true,
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			return nil, ErrBadQueryParams
+		}
+
+		if value > maxPageLimit {
+			value = maxPageLimit
+		}
+
+		page.Limit = value
+	}
+
+	if sortField := values.Get("sort"); sortField != "" {
+		if !sortableActivityFields[sortField] {
+			return nil, ErrBadQueryParams
+		}
+
+		page.SortField = sortField
+	}
+
+	switch values.Get("order") {
+	case "", "desc":
+		page.Descending = true
+	case "asc":
+		page.Descending = false
+	default:
+		return nil, ErrBadQueryParams
+	}
+
+	return page, nil
+}
+
+func (page *PageRequest) sortSignature() string {
+	if page.Descending {
+		return "-" + page.SortField
+	}
+
+	return page.SortField
+}
+
+func (page *PageRequest) sortOrder() []string {
+	if page.Descending {
+		return []string{"-" + page.SortField, "-_id"}
+	}
+
+	return []string{page.SortField, "_id"}
+}
+
+func (page *PageRequest) encodeCursor(value *int64, id bson.ObjectId) string {
+	data, _ := json.Marshal(pageCursor{Sort: page.sortSignature(), Value: value, Id: id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//cursorQuery returns condition selecting items placed after cursor in requested order
+func (page *PageRequest) cursorQuery() (bson.M, error) {
+
+	if page.Cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(page.Cursor)
+	if err != nil {
+		return nil, ErrBadQueryParams
+	}
+
+	var cursor pageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || !cursor.Id.Valid() {
+		return nil, ErrBadQueryParams
+	}
+
+	if cursor.Sort != page.sortSignature() {
+		return nil, ErrBadQueryParams
+	}
+
+	field := page.SortField
+	missing := bson.M{field: nil}
+	present := bson.M{field: bson.M{"$ne": nil}}
+
+	if page.Descending {
+		if cursor.Value == nil {
+			return bson.M{"$and": []bson.M{missing, {"_id": bson.M{"$lt": cursor.Id}}}}, nil
+		}
+
+		return bson.M{"$or": []bson.M{
+			{field: bson.M{"$lt": *cursor.Value}},
+			{field: *cursor.Value, "_id": bson.M{"$lt": cursor.Id}},
+			missing,
+		}}, nil
+	}
+
+	if cursor.Value == nil {
+		return bson.M{"$or": []bson.M{
+			{"$and": []bson.M{missing, {"_id": bson.M{"$gt": cursor.Id}}}},
+			present,
+		}}, nil
+	}
+
+	return bson.M{"$or": []bson.M{
+		{field: bson.M{"$gt": *cursor.Value}},
+		{field: *cursor.Value, "_id": bson.M{"$gt": cursor.Id}},
+	}}, nil
+}
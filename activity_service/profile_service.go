@@ -1,29 +1,55 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"net/http"
+	"net/mail"
 	"strings"
 	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"golang.org/x/crypto/bcrypt"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-var jwtKey = []byte("test_secret_key")
+//passwordResetTtl is how long emailed password reset token is valid
+const passwordResetTtl = time.Hour
 
-type JwtClaims struct {
-	Username string
-	jwt.StandardClaims
-}
+const minPasswordLength = 8
+
+//dummyPasswordHash is compared with password when profile isn't found, cost is the same as of stored hashes
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), 8)
+
+//emailVerificationTtl is how long emailed verification link is valid
+const emailVerificationTtl = 48 * time.Hour
+
+//verificationResendInterval limits how often verification mail is sent again
+const verificationResendInterval = time.Minute
+
+//passwordResetInterval limits how often reset token is issued for the same profile
+const passwordResetInterval = time.Minute
 
 type ProfileService struct {
 	storage *MongoDbStorage
+	//restrictedFeatures are unavailable for profiles with unverified email
+	restrictedFeatures map[string]bool
 }
 
-func (service *ProfileService) CreateProfile(p *Profile) error {
+//validateEmail accepts plain address without display name
+func validateEmail(email string) error {
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrBadEmail
+	}
+
+	return nil
+}
+
+func (service *ProfileService) CreateProfile(p *Profile) (*Profile, error) {
+
+	if err := validateEmail(p.Email); err != nil {
+		return nil, err
+	}
 
 	dbStorage := service.storage
 	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
@@ -37,24 +63,165 @@ func (service *ProfileService) CreateProfile(p *Profile) error {
 	profilesCollection.Find(query).All(&existingProfiles)
 
 	if len(existingProfiles) > 0 {
-		return ErrAlreadyExists
+		return nil, ErrAlreadyExists
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(p.Password), 8)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	storeProfile := &Profile{Id: bson.NewObjectId(), Email: p.Email, UserName: p.UserName, Password: string(hashedPassword[:])}
 	err = profilesCollection.Insert(storeProfile)
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return storeProfile, nil
+}
+
+//MarkLegacyProfilesVerified treats profiles created before email verification as verified
+func (service *ProfileService) MarkLegacyProfilesVerified() error {
+
+	dbStorage := service.storage
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+
+	_, err := profilesCollection.UpdateAll(bson.M{"email_verified": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"email_verified": true}})
+	return err
+}
+
+//CreateEmailVerification issues token confirming that profile owns email.
+//Previous token of profile stops working
+func (service *ProfileService) CreateEmailVerification(profileId bson.ObjectId, email string) (string, error) {
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	dbStorage := service.storage
+	verificationsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("email_verifications")
+
+	_, err = verificationsCollection.Upsert(bson.M{"profile_id": profileId}, bson.M{"$set": bson.M{
+		"email":      email,
+		"token_hash": hashToken(token),
+		"created_at": now.Unix(),
+		"expire_at":  now.Add(emailVerificationTtl),
+	}})
+
+	if err != nil {
+		return "", ErrStorageError
+	}
+
+	return token, nil
+}
+
+//RecreateEmailVerification issues new token for unverified profile with email.
+//Nothing is issued when profile doesn't exist, is verified or was sent token recently
+func (service *ProfileService) RecreateEmailVerification(email string) (*Profile, string, error) {
+
+	dbStorage := service.storage
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+
+	profile := Profile{}
+	err := profilesCollection.Find(bson.M{"email": email, "email_verified": false}).One(&profile)
+	if err == mgo.ErrNotFound {
+		return nil, "", ErrNotExists
+	}
+
+	if err != nil {
+		return nil, "", ErrStorageError
+	}
+
+	verificationsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("email_verifications")
+	recent, err := verificationsCollection.Find(bson.M{
+		"profile_id": profile.Id,
+		"created_at": bson.M{"$gt": time.Now().Add(-verificationResendInterval).Unix()},
+	}).Count()
+
+	if err != nil {
+		return nil, "", ErrStorageError
+	}
+
+	if recent > 0 {
+		return nil, "", ErrNotExists
+	}
+
+	token, err := service.CreateEmailVerification(profile.Id, profile.Email)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &profile, token, nil
+}
+
+//VerifyEmail confirms address by single-use token and makes it profile email
+func (service *ProfileService) VerifyEmail(token string) error {
+
+	dbStorage := service.storage
+	verificationsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("email_verifications")
+
+	verification := EmailVerification{}
+	_, err := verificationsCollection.Find(bson.M{
+		"token_hash": hashToken(token),
+		"expire_at":  bson.M{"$gt": time.Now()},
+	}).Apply(mgo.Change{Remove: true}, &verification)
+
+	if err == mgo.ErrNotFound {
+		return ErrInvalidVerifyToken
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+	owners, err := profilesCollection.Find(bson.M{"email": verification.Email, "_id": bson.M{"$ne": verification.ProfileId}}).Count()
+	if err != nil {
+		return ErrStorageError
+	}
+
+	if owners > 0 {
+		return ErrAlreadyExists
+	}
+
+	err = profilesCollection.UpdateId(verification.ProfileId, bson.M{"$set": bson.M{"email": verification.Email, "email_verified": true}})
+	if err == mgo.ErrNotFound {
+		return ErrInvalidVerifyToken
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//CheckFeatureAllowed returns ErrEmailNotVerified when profile has
+//unverified email and feature is restricted for such profiles
+func (service *ProfileService) CheckFeatureAllowed(profileId bson.ObjectId, feature string) error {
+
+	if !service.restrictedFeatures[feature] {
+		return nil
+	}
+
+	dbStorage := service.storage
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+	verified, err := profilesCollection.Find(bson.M{"_id": profileId, "email_verified": true}).Count()
 	if err != nil {
 		return ErrStorageError
 	}
 
+	if verified == 0 {
+		return ErrEmailNotVerified
+	}
+
 	return nil
 }
 
-func (service *ProfileService) Login(p *Profile) (*SessionInfo, error) {
+//CheckCredentials returns profile with email and password of p
+func (service *ProfileService) CheckCredentials(p *Profile) (*Profile, error) {
 
 	dbStorage := service.storage
 	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
@@ -68,6 +235,8 @@ func (service *ProfileService) Login(p *Profile) (*SessionInfo, error) {
 	profilesCollection.Find(query).All(&existingProfiles)
 
 	if len(existingProfiles) == 0 {
+		//password is checked anyway, so response time doesn't tell whether email is registered
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(p.Password))
 		return nil, ErrProfileDoesntExist
 	}
 
@@ -75,57 +244,155 @@ func (service *ProfileService) Login(p *Profile) (*SessionInfo, error) {
 		return nil, ErrWrongPassword
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &JwtClaims{
-		Username: existingProfiles[0].Id.String(),
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+	return &existingProfiles[0], nil
+}
+
+func (service *ProfileService) GetProfileByEmail(email string) (*Profile, error) {
+
+	dbStorage := service.storage
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+
+	profile := Profile{}
+	err := profilesCollection.Find(bson.M{"email": email}).One(&profile)
+	if err == mgo.ErrNotFound {
+		return nil, ErrProfileDoesntExist
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	profile.Password = ""
+	return &profile, nil
+}
+
+//EnsureIndexes creates indexes of password reset and email verification tokens,
+//expired tokens are removed by mongo
+func (service *ProfileService) EnsureIndexes() error {
+
+	dbStorage := service.storage
+	resetsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("password_resets")
+
+	if err := resetsCollection.EnsureIndex(mgo.Index{Key: []string{"token_hash"}, Unique: true, Background: true}); err != nil {
+		return err
+	}
+
+	if err := resetsCollection.EnsureIndex(mgo.Index{Key: []string{"profile_id"}, Unique: true, Background: true}); err != nil {
+		return err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	if err := resetsCollection.EnsureIndex(mgo.Index{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true}); err != nil {
+		return err
+	}
+
+	verificationsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("email_verifications")
+	if err := verificationsCollection.EnsureIndex(mgo.Index{Key: []string{"token_hash"}, Unique: true, Background: true}); err != nil {
+		return err
+	}
+
+	return verificationsCollection.EnsureIndex(mgo.Index{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true})
+}
+
+//CreatePasswordResetToken issues single-use reset token for profile with email.
+//Only hash of token is stored and previous token of profile stops working.
+//Nothing is issued when profile was issued token recently
+func (service *ProfileService) CreatePasswordResetToken(email string) (*Profile, string, error) {
+
+	dbStorage := service.storage
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+
+	profile := Profile{}
+	err := profilesCollection.Find(bson.M{"email": email}).One(&profile)
+	if err == mgo.ErrNotFound {
+		return nil, "", ErrProfileDoesntExist
+	}
 
 	if err != nil {
-		return nil, ErrCreateJwtToken
+		return nil, "", ErrStorageError
 	}
 
-	log.Printf("JWT token: %s", tokenString)
+	token, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
 
-	storeSession := &SessionInfo{Id: bson.NewObjectId(), ProfileId: existingProfiles[0].Id, SessionId: tokenString}
-	sessionCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
+	now := time.Now()
+	resetsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("password_resets")
+	//recent token doesn't match filter, then upsert conflicts on unique profile_id
+	_, err = resetsCollection.Upsert(bson.M{
+		"profile_id": profile.Id,
+		"created_at": bson.M{"$lte": now.Add(-passwordResetInterval).Unix()},
+	}, bson.M{"$set": bson.M{
+		"token_hash": hashToken(token),
+		"created_at": now.Unix(),
+		"expire_at":  now.Add(passwordResetTtl),
+	}})
+
+	if mgo.IsDup(err) {
+		return nil, "", ErrNotExists
+	}
 
-	if err := sessionCollection.Insert(storeSession); err != nil {
-		return nil, ErrStorageError
+	if err != nil {
+		return nil, "", ErrStorageError
 	}
 
-	return storeSession, nil
+	return &profile, token, nil
 }
 
-func (service *ProfileService) Logout(tokenString string) error {
+//ResetPassword sets new password by reset token and closes all sessions of profile.
+//Token is removed before password is changed, so it can't be used twice
+func (service *ProfileService) ResetPassword(token string, password string) error {
+
+	if len(password) < minPasswordLength {
+		return ErrWeakPassword
+	}
 
 	dbStorage := service.storage
-	sessionCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
-	query := bson.M{
-		"session_id": bson.M{
-			"$eq": tokenString,
-		},
+	resetsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("password_resets")
+
+	resetToken := PasswordResetToken{}
+	_, err := resetsCollection.Find(bson.M{
+		"token_hash": hashToken(token),
+		"expire_at":  bson.M{"$gt": time.Now()},
+	}).Apply(mgo.Change{Remove: true}, &resetToken)
+
+	if err == mgo.ErrNotFound {
+		return ErrInvalidResetToken
 	}
 
-	err := sessionCollection.Remove(query)
 	if err != nil {
 		return ErrStorageError
 	}
 
-	return nil
-}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 8)
+	if err != nil {
+		return err
+	}
+
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+	err = profilesCollection.UpdateId(resetToken.ProfileId, bson.M{"$set": bson.M{"password": string(hashedPassword)}})
+	if err == mgo.ErrNotFound {
+		return ErrInvalidResetToken
+	}
 
-func (service *ProfileService) ResetPassword() {
+	if err != nil {
+		return ErrStorageError
+	}
+
+	sessionCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
+	if _, err := sessionCollection.RemoveAll(bson.M{"profile_id": resetToken.ProfileId}); err != nil {
+		return ErrStorageError
+	}
 
+	return nil
 }
 
 func (service *ProfileService) GetProfileInfo(id string) (*Profile, error) {
 
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotExists
+	}
+
 	dbStorage := service.storage
 	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
 	query := bson.M{
@@ -145,11 +412,95 @@ func (service *ProfileService) GetProfileInfo(id string) (*Profile, error) {
 		return nil, ErrNotExists
 	}
 
+	storedProfiles[0].Password = ""
 	return &storedProfiles[0], nil
 }
 
-func (service *ProfileService) UpdateProfileInfo(id string, p *Profile) error {
-	return nil
+//UpdateProfileInfo applies partial update of profile. Changed email is
+//returned as pending, it replaces current one after confirmation of new address.
+//Password change closes all sessions of profile except current one
+func (service *ProfileService) UpdateProfileInfo(id string, sessionId string, update *ProfileUpdate) (*ProfileUpdateResult, error) {
+
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotExists
+	}
+
+	dbStorage := service.storage
+	sessionCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
+	profilesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("profiles")
+
+	profile := Profile{}
+	err := profilesCollection.FindId(bson.ObjectIdHex(id)).One(&profile)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotExists
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	changes := bson.M{}
+	result := &ProfileUpdateResult{Profile: &profile}
+
+	if update.UserName != nil {
+		userName := strings.TrimSpace(*update.UserName)
+		if userName == "" {
+			return nil, ErrBadHttpRequestBody
+		}
+
+		changes["username"] = userName
+		profile.UserName = userName
+	}
+
+	if update.Password != nil {
+		if err := bcrypt.CompareHashAndPassword([]byte(profile.Password), []byte(update.CurrentPassword)); err != nil {
+			return nil, ErrWrongPassword
+		}
+
+		if len(*update.Password) < minPasswordLength {
+			return nil, ErrWeakPassword
+		}
+
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*update.Password), 8)
+		if err != nil {
+			return nil, err
+		}
+
+		changes["password"] = string(hashedPassword)
+	}
+
+	if update.Email != nil && *update.Email != profile.Email {
+		if err := validateEmail(*update.Email); err != nil {
+			return nil, err
+		}
+
+		owners, err := profilesCollection.Find(bson.M{"email": *update.Email}).Count()
+		if err != nil {
+			return nil, ErrStorageError
+		}
+
+		if owners > 0 {
+			return nil, ErrAlreadyExists
+		}
+
+		result.PendingEmail = *update.Email
+	}
+
+	if len(changes) > 0 {
+		if err := profilesCollection.UpdateId(profile.Id, bson.M{"$set": changes}); err != nil {
+			return nil, ErrStorageError
+		}
+	}
+
+	if update.Password != nil {
+		_, err := sessionCollection.RemoveAll(bson.M{"profile_id": profile.Id, "_id": bson.M{"$ne": bson.ObjectIdHex(sessionId)}})
+		if err != nil {
+			return nil, ErrStorageError
+		}
+	}
+
+	profile.Password = ""
+	return result, nil
 }
 
 func (service *ProfileService) UpdateProfileAvatar(id string, avatarPath string) error {
@@ -204,49 +555,13 @@ func (service *ProfileService) GetProfileAvatar(id string) (string, error) {
 	return avatars[0].AvatarFilePath, nil
 }
 
-func (service *ProfileService) AuthBySessionToken(tokenString string) error {
-
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Error during check access token")
-		}
-
-		return jwtKey, nil
-	})
-
-	if err != nil {
-		return ErrUnauthoriazedAccess
-	}
-
-	if !token.Valid {
-		return ErrUnauthoriazedAccess
-	}
-
-	dbStorage := service.storage
-	sessionCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
-	query := bson.M{
-		"session_id": bson.M{
-			"$eq": tokenString,
-		},
-	}
-
-	existingSessions := []SessionInfo{}
-	sessionCollection.Find(query).All(&existingSessions)
-
-	if len(existingSessions) == 0 {
-		return ErrUnauthoriazedAccess
-	}
-
-	return nil
-}
-
 func (service *ProfileService) ExtractTokenFromRequest(r *http.Request) (string, error) {
 
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader != "" {
 		bearerToken := strings.Split(authorizationHeader, " ")
 
-		if len(bearerToken) == 2 {
+		if len(bearerToken) == 2 && strings.EqualFold(bearerToken[0], "Bearer") && bearerToken[1] != "" {
 			return bearerToken[1], nil
 		} else {
 			return "", ErrParseAuthorizationHeader
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const maxReportBuckets = 1000
+
+type ReportsService struct {
+	storage *MongoDbStorage
+}
+
+//reportSegment is part of report range which tracked time is summed by
+type reportSegment struct {
+	Bucket int    `bson:"bucket"`
+	Key    string `bson:"key,omitempty"`
+	Start  int64  `bson:"start"`
+	End    int64  `bson:"end"`
+}
+
+//reportSum is tracked time of one group in bucket summed by database
+type reportSum struct {
+	Id struct {
+		Bucket int    `bson:"bucket"`
+		Key    string `bson:"key"`
+	} `bson:"_id"`
+	Duration int64 `bson:"duration"`
+}
+
+//ParseReportRequest reads period, group_by, tz, from and to query parameters.
+//Without from and to report covers current period in requested timezone
+func ParseReportRequest(values url.Values) (*ReportRequest, error) {
+
+	request := &ReportRequest{
+		Period:   values.Get("period"),
+		GroupBy:  values.Get("group_by"),
+		Location: time.UTC,
+	}
+
+	switch request.Period {
+	case "":
+		request.Period = ReportPeriodDay
+	case ReportPeriodDay, ReportPeriodWeek, ReportPeriodMonth:
+	default:
+		return nil, ErrBadQueryParams
+	}
+
+	switch request.GroupBy {
+	case "":
+		request.GroupBy = ReportGroupByCategory
+	case ReportGroupByCategory, ReportGroupByDay:
+	default:
+		return nil, ErrBadQueryParams
+	}
+
+	if tz := values.Get("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, ErrBadQueryParams
+		}
+
+		request.Location = location
+	}
+
+	if workspaceId := values.Get("workspace_id"); workspaceId != "" {
+		if !bson.IsObjectIdHex(workspaceId) {
+			return nil, ErrBadQueryParams
+		}
+
+		request.WorkspaceId = workspaceId
+	}
+
+	var err error
+	if request.From, err = parseTimeParam(values.Get("from")); err != nil {
+		return nil, ErrBadQueryParams
+	}
+
+	if request.To, err = parseTimeParam(values.Get("to")); err != nil {
+		return nil, ErrBadQueryParams
+	}
+
+	if request.From == 0 {
+		anchor := time.Now()
+		if request.To != 0 {
+			anchor = time.Unix(request.To-1, 0)
+		}
+
+		request.From = periodStart(anchor.In(request.Location), request.Period).Unix()
+	}
+
+	if request.To == 0 {
+		request.To = nextPeriodStart(periodStart(time.Unix(request.From, 0).In(request.Location), request.Period), request.Period).Unix()
+	}
+
+	if request.From >= request.To {
+		return nil, ErrBadQueryParams
+	}
+
+	return request, nil
+}
+
+//periodStart returns beginning of local day, week (monday) or month containing t
+func periodStart(t time.Time, period string) time.Time {
+
+	year, month, day := t.Date()
+	switch period {
+	case ReportPeriodWeek:
+		weekday := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-weekday, 0, 0, 0, 0, t.Location())
+	case ReportPeriodMonth:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+	}
+}
+
+func nextPeriodStart(t time.Time, period string) time.Time {
+
+	switch period {
+	case ReportPeriodWeek:
+		return t.AddDate(0, 0, 7)
+	case ReportPeriodMonth:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+//GetReport sums tracked time of profile by period buckets. Intervals crossing
+//bucket boundary are split between buckets by local time of requested timezone
+func (service *ReportsService) GetReport(profileId string, request *ReportRequest) (*Report, error) {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return nil, ErrBadQueryParams
+	}
+
+	report := &Report{
+		Period:   request.Period,
+		GroupBy:  request.GroupBy,
+		Timezone: request.Location.String(),
+		From:     request.From,
+		To:       request.To,
+		Buckets:  []ReportBucket{},
+	}
+
+	start := time.Unix(request.From, 0).In(request.Location)
+	end := time.Unix(request.To, 0).In(request.Location)
+	for bucketStart := start; bucketStart.Before(end); {
+		bucketEnd := nextPeriodStart(periodStart(bucketStart, request.Period), request.Period)
+		if bucketEnd.After(end) {
+			bucketEnd = end
+		}
+
+		report.Buckets = append(report.Buckets, ReportBucket{Start: bucketStart.Unix(), End: bucketEnd.Unix(), Groups: []ReportGroup{}})
+		if len(report.Buckets) > maxReportBuckets {
+			return nil, ErrBadQueryParams
+		}
+
+		bucketStart = bucketEnd
+	}
+
+	dbStorage := service.storage
+	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("activities")
+
+	now := time.Now().Unix()
+	overlap := bson.M{
+		"work_intervals.begin": bson.M{"$lt": request.To},
+		"$or": []bson.M{
+			{"work_intervals.end": 0},
+			{"work_intervals.end": bson.M{"$gt": request.From}},
+		},
+	}
+
+	match := bson.M{
+		"profile_id": bson.ObjectIdHex(profileId),
+		"work_intervals": bson.M{"$elemMatch": bson.M{
+			"begin": bson.M{"$lt": request.To},
+			"$or": []bson.M{
+				{"end": 0},
+				{"end": bson.M{"$gt": request.From}},
+			},
+		}},
+	}
+
+	if request.WorkspaceId != "" {
+		match["workspace_id"] = bson.ObjectIdHex(request.WorkspaceId)
+	}
+
+	//every clipped interval is cut by segments it overlaps, so database returns only sums per bucket and group
+	segments := reportSegments(report, request)
+	groupKey := interface{}(bson.M{"$ifNull": []interface{}{"$category", ""}})
+	if request.GroupBy == ReportGroupByDay {
+		groupKey = "$segment.key"
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$unwind": "$work_intervals"},
+		{"$match": overlap},
+		{"$project": bson.M{
+			"_id":      0,
+			"category": "$category",
+			"begin":    bson.M{"$max": []interface{}{"$work_intervals.begin", request.From}},
+			"end": bson.M{"$min": []interface{}{
+				bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$work_intervals.end", 0}}, now, "$work_intervals.end"}},
+				request.To,
+			}},
+		}},
+		{"$project": bson.M{
+			"category": 1,
+			"begin":    1,
+			"end":      1,
+			"segment": bson.M{"$filter": bson.M{
+				"input": bson.M{"$literal": segments},
+				"as":    "segment",
+				"cond": bson.M{"$and": []interface{}{
+					bson.M{"$lt": []interface{}{"$begin", "$end"}},
+					bson.M{"$lt": []interface{}{"$$segment.start", "$end"}},
+					bson.M{"$gt": []interface{}{"$$segment.end", "$begin"}},
+				}},
+			}},
+		}},
+		{"$unwind": "$segment"},
+		{"$group": bson.M{
+			"_id": bson.M{"bucket": "$segment.bucket", "key": groupKey},
+			"duration": bson.M{"$sum": bson.M{"$subtract": []interface{}{
+				bson.M{"$min": []interface{}{"$end", "$segment.end"}},
+				bson.M{"$max": []interface{}{"$begin", "$segment.start"}},
+			}}},
+		}},
+	}
+
+	sums := []reportSum{}
+	if err := activitiesCollection.Pipe(pipeline).AllowDiskUse().All(&sums); err != nil {
+		return nil, ErrStorageError
+	}
+
+	for _, sum := range sums {
+		if sum.Id.Bucket < 0 || sum.Id.Bucket >= len(report.Buckets) || sum.Duration <= 0 {
+			continue
+		}
+
+		bucket := &report.Buckets[sum.Id.Bucket]
+		bucket.Groups = append(bucket.Groups, ReportGroup{Key: sum.Id.Key, Duration: sum.Duration})
+		bucket.Total += sum.Duration
+	}
+
+	for i := range report.Buckets {
+		bucket := &report.Buckets[i]
+		sort.Slice(bucket.Groups, func(a, b int) bool {
+			return bucket.Groups[a].Key < bucket.Groups[b].Key
+		})
+
+		report.Total += bucket.Total
+	}
+
+	return report, nil
+}
+
+//reportSegments cuts report range by buckets and, when grouping by day, by local days inside buckets
+func reportSegments(report *Report, request *ReportRequest) []reportSegment {
+
+	segments := []reportSegment{}
+	for i, bucket := range report.Buckets {
+		if request.GroupBy != ReportGroupByDay {
+			segments = append(segments, reportSegment{Bucket: i, Start: bucket.Start, End: bucket.End})
+			continue
+		}
+
+		for dayStart := time.Unix(bucket.Start, 0).In(request.Location); dayStart.Unix() < bucket.End; {
+			dayEnd := nextPeriodStart(periodStart(dayStart, ReportPeriodDay), ReportPeriodDay)
+
+			segmentEnd := bucket.End
+			if dayEnd.Unix() < segmentEnd {
+				segmentEnd = dayEnd.Unix()
+			}
+
+			segments = append(segments, reportSegment{Bucket: i, Key: dayStart.Format("2006-01-02"), Start: dayStart.Unix(), End: segmentEnd})
+			dayStart = dayEnd
+		}
+	}
+
+	return segments
+}
@@ -4,6 +4,14 @@ type ServiceProvider struct {
 	pr *ProfileService
 	ar *ActivitiesService
 	sr *SettingsService
+	rr *ReportsService
+	cr *CalendarService
+	ss *SessionService
+	tf *TwoFactorService
+	lg *LoginGuardService
+	oi *OidcService
+	at *ApiTokenService
+	ws *WorkspaceService
 
 	initialized bool
 }
@@ -32,11 +40,89 @@ func (provider *ServiceProvider) GetSettingsService() *SettingsService {
 	return provider.sr
 }
 
-func NewServiceProvider(mongoStorage *MongoDbStorage) *ServiceProvider {
+func (provider *ServiceProvider) GetReportsService() *ReportsService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.rr
+}
+
+func (provider *ServiceProvider) GetCalendarService() *CalendarService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.cr
+}
+
+func (provider *ServiceProvider) GetSessionService() *SessionService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.ss
+}
+
+func (provider *ServiceProvider) GetTwoFactorService() *TwoFactorService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.tf
+}
+
+func (provider *ServiceProvider) GetLoginGuardService() *LoginGuardService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.lg
+}
+
+func (provider *ServiceProvider) GetOidcService() *OidcService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.oi
+}
+
+func (provider *ServiceProvider) GetApiTokenService() *ApiTokenService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.at
+}
+
+func (provider *ServiceProvider) GetWorkspaceService() *WorkspaceService {
+	if !provider.initialized {
+		panic("Service provider was not initialized")
+	}
+
+	return provider.ws
+}
+
+func NewServiceProvider(config *Config, mongoStorage *MongoDbStorage, keys *JwtKeySet) *ServiceProvider {
+
+	restrictedFeatures := map[string]bool{}
+	for _, feature := range config.UnverifiedRestrictions {
+		restrictedFeatures[feature] = true
+	}
+
 	return &ServiceProvider{
-		pr:          &ProfileService{storage: mongoStorage},
+		pr:          &ProfileService{storage: mongoStorage, restrictedFeatures: restrictedFeatures},
 		ar:          &ActivitiesService{storage: mongoStorage},
 		sr:          &SettingsService{storage: mongoStorage},
+		rr:          &ReportsService{storage: mongoStorage},
+		cr:          &CalendarService{storage: mongoStorage},
+		ss:          &SessionService{storage: mongoStorage, keys: keys},
+		tf:          &TwoFactorService{storage: mongoStorage},
+		lg:          &LoginGuardService{storage: mongoStorage},
+		oi:          NewOidcService(mongoStorage, config.Oidc),
+		at:          &ApiTokenService{storage: mongoStorage},
+		ws:          &WorkspaceService{storage: mongoStorage},
 		initialized: true,
 	}
 }
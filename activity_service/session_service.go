@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//accessTokenTtl is lifetime of jwt access token, it is renewed by refresh token
+const accessTokenTtl = 15 * time.Minute
+
+//refreshTokenTtl is how long session lives without refresh, expired sessions are removed by mongo
+const refreshTokenTtl = 30 * 24 * time.Hour
+
+//lastSeenInterval limits how often last seen time of session is written
+const lastSeenInterval = time.Minute
+
+//usedRefreshTokensLimit is number of rotated refresh tokens remembered to detect their reuse
+const usedRefreshTokensLimit = 20
+
+//AccessClaims are claims of access token, subject is hex id of profile
+type AccessClaims struct {
+	SessionId string `json:"sid"`
+	jwt.StandardClaims
+}
+
+type SessionService struct {
+	storage *MongoDbStorage
+	keys    *JwtKeySet
+}
+
+//ClientInfoFromRequest describes device which opens or refreshes session. X-Forwarded-For
+//is used only behind trusted proxy, the last address in it is the one proxy has seen
+func ClientInfoFromRequest(config *Config, r *http.Request, device string) ClientInfo {
+
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" && config.TrustProxyHeaders {
+		addresses := strings.Split(forwarded, ",")
+		ip = strings.TrimSpace(addresses[len(addresses)-1])
+	}
+
+	return ClientInfo{Device: device, Ip: ip, UserAgent: r.UserAgent()}
+}
+
+func (service *SessionService) sessions() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("sessions")
+}
+
+//EnsureIndexes creates session indexes. Sessions of previous format
+//without expiration time are removed, their owners have to sign in again
+func (service *SessionService) EnsureIndexes() error {
+
+	sessionCollection := service.sessions()
+
+	indexes := []mgo.Index{
+		{Key: []string{"profile_id", "-last_seen_at"}, Background: true},
+		{Key: []string{"refresh_token_hash"}, Background: true},
+		{Key: []string{"used_refresh_hashes"}, Background: true},
+		{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true},
+	}
+
+	for _, index := range indexes {
+		if err := sessionCollection.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+
+	_, err := sessionCollection.RemoveAll(bson.M{"expire_at": bson.M{"$exists": false}})
+	return err
+}
+
+//CreateSession opens session of profile on client device and issues its tokens
+func (service *SessionService) CreateSession(profileId bson.ObjectId, client ClientInfo) (*SessionTokens, error) {
+
+	refreshToken, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	storeSession := &SessionInfo{
+		Id:                bson.NewObjectId(),
+		ProfileId:         profileId,
+		Device:            client.Device,
+		Ip:                client.Ip,
+		UserAgent:         client.UserAgent,
+		CreatedAt:         now.Unix(),
+		LastSeenAt:        now.Unix(),
+		RefreshTokenHash:  hashToken(refreshToken),
+		UsedRefreshHashes: []string{},
+		ExpireAt:          now.Add(refreshTokenTtl),
+	}
+
+	if err := service.sessions().Insert(storeSession); err != nil {
+		return nil, ErrStorageError
+	}
+
+	return service.issueTokens(storeSession, refreshToken)
+}
+
+func (service *SessionService) issueTokens(session *SessionInfo, refreshToken string) (*SessionTokens, error) {
+
+	now := time.Now()
+	claims := &AccessClaims{
+		SessionId: session.Id.Hex(),
+		StandardClaims: jwt.StandardClaims{
+			Subject:   session.ProfileId.Hex(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenTtl).Unix(),
+		},
+	}
+
+	tokenString, err := service.keys.Sign(claims)
+
+	if err != nil {
+		return nil, ErrCreateJwtToken
+	}
+
+	return &SessionTokens{
+		ProfileId:    session.ProfileId,
+		SessionId:    session.Id.Hex(),
+		AccessToken:  tokenString,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(accessTokenTtl / time.Second),
+	}, nil
+}
+
+//Refresh exchanges refresh token for new pair of tokens, refresh token can be used once.
+//Presenting already rotated token means it was stolen, so whole session is revoked
+func (service *SessionService) Refresh(refreshToken string, client ClientInfo) (*SessionTokens, error) {
+
+	newRefreshToken, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tokenHash := hashToken(refreshToken)
+	sessionCollection := service.sessions()
+
+	update := bson.M{
+		"$set": bson.M{
+			"refresh_token_hash": hashToken(newRefreshToken),
+			"last_seen_at":       now.Unix(),
+			"ip":                 client.Ip,
+			"user_agent":         client.UserAgent,
+			"expire_at":          now.Add(refreshTokenTtl),
+		},
+		"$push": bson.M{
+			"used_refresh_hashes": bson.M{"$each": []string{tokenHash}, "$slice": -usedRefreshTokensLimit},
+		},
+	}
+
+	session := SessionInfo{}
+	_, err = sessionCollection.Find(bson.M{
+		"refresh_token_hash": tokenHash,
+		"expire_at":          bson.M{"$gt": now},
+	}).Apply(mgo.Change{Update: update, ReturnNew: true}, &session)
+
+	if err == nil {
+		return service.issueTokens(&session, newRefreshToken)
+	}
+
+	if err != mgo.ErrNotFound {
+		return nil, ErrStorageError
+	}
+
+	_, err = sessionCollection.Find(bson.M{"used_refresh_hashes": tokenHash}).Apply(mgo.Change{Remove: true}, &session)
+	if err == nil {
+		return nil, ErrRefreshTokenReused
+	}
+
+	if err != mgo.ErrNotFound {
+		return nil, ErrStorageError
+	}
+
+	return nil, ErrUnauthoriazedAccess
+}
+
+//AuthBySessionToken checks access token and returns session it was issued for
+func (service *SessionService) AuthBySessionToken(tokenString string) (*SessionInfo, error) {
+
+	claims, err := service.keys.Parse(tokenString)
+	if err != nil || !bson.IsObjectIdHex(claims.SessionId) || !bson.IsObjectIdHex(claims.Subject) {
+		return nil, ErrUnauthoriazedAccess
+	}
+
+	now := time.Now()
+	sessionCollection := service.sessions()
+
+	session := SessionInfo{}
+	err = sessionCollection.Find(bson.M{
+		"_id":        bson.ObjectIdHex(claims.SessionId),
+		"profile_id": bson.ObjectIdHex(claims.Subject),
+		"expire_at":  bson.M{"$gt": now},
+	}).One(&session)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrUnauthoriazedAccess
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if now.Unix()-session.LastSeenAt >= int64(lastSeenInterval/time.Second) {
+		session.LastSeenAt = now.Unix()
+		sessionCollection.UpdateId(session.Id, bson.M{"$set": bson.M{"last_seen_at": session.LastSeenAt}})
+	}
+
+	return &session, nil
+}
+
+//ListSessions returns active sessions of profile, recently used first
+func (service *SessionService) ListSessions(profileId bson.ObjectId) ([]SessionInfo, error) {
+
+	sessions := []SessionInfo{}
+	err := service.sessions().Find(bson.M{
+		"profile_id": profileId,
+		"expire_at":  bson.M{"$gt": time.Now()},
+	}).Sort("-last_seen_at").All(&sessions)
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return sessions, nil
+}
+
+func (service *SessionService) RevokeSession(profileId bson.ObjectId, sessionId string) error {
+
+	if !bson.IsObjectIdHex(sessionId) {
+		return ErrNotExists
+	}
+
+	err := service.sessions().Remove(bson.M{"_id": bson.ObjectIdHex(sessionId), "profile_id": profileId})
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//RevokeAllSessions closes sessions of profile, except one when exceptSessionId is set
+func (service *SessionService) RevokeAllSessions(profileId bson.ObjectId, exceptSessionId string) (int, error) {
+
+	query := bson.M{"profile_id": profileId}
+	if bson.IsObjectIdHex(exceptSessionId) {
+		query["_id"] = bson.M{"$ne": bson.ObjectIdHex(exceptSessionId)}
+	}
+
+	info, err := service.sessions().RemoveAll(query)
+	if err != nil {
+		return 0, ErrStorageError
+	}
+
+	return info.Removed, nil
+}
@@ -8,6 +8,10 @@ type SettingsService struct {
 
 func (service *SettingsService) UpdateSettings(profileId string, setting *Setting) error {
 
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrNotExists
+	}
+
 	dbStorage := service.storage
 	settingsCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("settings")
 	query := bson.M{
@@ -21,6 +25,8 @@ func (service *SettingsService) UpdateSettings(profileId string, setting *Settin
 
 	if len(settings) == 0 {
 
+		setting.Id = ""
+		setting.ProfileId = bson.ObjectIdHex(profileId)
 		if err := settingsCollection.Insert(setting); err != nil {
 			return ErrStorageError
 		}
@@ -45,6 +51,10 @@ func (service *SettingsService) UpdateSettings(profileId string, setting *Settin
 
 func (service *SettingsService) GetSettings(profileId string) (*Setting, error) {
 
+	if !bson.IsObjectIdHex(profileId) {
+		return nil, ErrNotExists
+	}
+
 	dbStorage := service.storage
 	activitiesCollection := dbStorage.mgoSession.DB(dbStorage.dbName).C("settings")
 	query := bson.M{
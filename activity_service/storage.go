@@ -21,3 +21,7 @@ func NewMongoStorage(url string, dbName string) *MongoDbStorage {
 
 	return &MongoDbStorage{mgoSession: s, dbName: dbName}
 }
+
+func (storage *MongoDbStorage) Close() {
+	storage.mgoSession.Close()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//totpIssuer is shown by authenticator applications near account email
+const totpIssuer = "TimeTracker"
+
+//totpPeriod and totpDigits are defaults of RFC 6238 supported by all authenticator applications
+const (
+	totpPeriod = 30
+	totpDigits = 6
+)
+
+//totpSkew is number of periods before and after current accepted to tolerate clock drift
+const totpSkew = 1
+
+const recoveryCodesCount = 10
+
+//loginChallengeTtl is how long second step of sign in can be completed
+const loginChallengeTtl = 5 * time.Minute
+
+//loginChallengeAttempts limits codes checked by one challenge
+const loginChallengeAttempts = 5
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TwoFactorService struct {
+	storage *MongoDbStorage
+}
+
+//totpCode computes code of time step as described in RFC 4226 and RFC 6238
+func totpCode(secret []byte, step int64) string {
+
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+//matchTotp returns time step which code belongs to, or 0 when code is wrong
+func matchTotp(secret string, code string, now time.Time) int64 {
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step
+		}
+	}
+
+	return 0
+}
+
+//normalizeCode removes spaces and dashes users type in codes
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+func generateRecoveryCodes() ([]string, error) {
+
+	codes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+
+	return codes, nil
+}
+
+func (service *TwoFactorService) twoFactor() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("two_factor")
+}
+
+func (service *TwoFactorService) challenges() *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C("login_challenges")
+}
+
+func (service *TwoFactorService) EnsureIndexes() error {
+
+	if err := service.challenges().EnsureIndex(mgo.Index{Key: []string{"token_hash"}, Unique: true, Background: true}); err != nil {
+		return err
+	}
+
+	return service.challenges().EnsureIndex(mgo.Index{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true})
+}
+
+func (service *TwoFactorService) IsEnabled(profileId bson.ObjectId) (bool, error) {
+
+	count, err := service.twoFactor().Find(bson.M{"_id": profileId, "enabled": true}).Count()
+	if err != nil {
+		return false, ErrStorageError
+	}
+
+	return count > 0, nil
+}
+
+//BeginEnrollment generates new secret for profile. Two-factor authentication
+//is enabled only when code of this secret is verified by ConfirmEnrollment
+func (service *TwoFactorService) BeginEnrollment(profile *Profile) (*TotpEnrollment, error) {
+
+	enabled, err := service.IsEnabled(profile.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	secret := totpEncoding.EncodeToString(key)
+
+	_, err = service.twoFactor().UpsertId(profile.Id, bson.M{"$set": bson.M{
+		"enabled":        false,
+		"pending_secret": secret,
+	}})
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	provisioningUri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + profile.Email,
+		RawQuery: query.Encode(),
+	}
+
+	return &TotpEnrollment{Secret: secret, ProvisioningUri: provisioningUri.String()}, nil
+}
+
+//ConfirmEnrollment enables two-factor authentication when code matches pending secret.
+//Recovery codes are returned once, only their hashes are stored
+func (service *TwoFactorService) ConfirmEnrollment(profileId bson.ObjectId, code string) ([]string, error) {
+
+	state := TwoFactorState{}
+	err := service.twoFactor().FindId(profileId).One(&state)
+	if err == mgo.ErrNotFound || (err == nil && (state.Enabled || state.PendingSecret == "")) {
+		return nil, ErrTwoFactorNotEnrolling
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	step := matchTotp(state.PendingSecret, normalizeCode(code), time.Now())
+	if step == 0 {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	recoveryCodes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryHashes := make([]string, 0, len(recoveryCodes))
+	for _, recoveryCode := range recoveryCodes {
+		recoveryHashes = append(recoveryHashes, hashToken(normalizeCode(recoveryCode)))
+	}
+
+	err = service.twoFactor().Update(bson.M{"_id": profileId, "pending_secret": state.PendingSecret}, bson.M{
+		"$set": bson.M{
+			"enabled":        true,
+			"secret":         state.PendingSecret,
+			"recovery_codes": recoveryHashes,
+			"last_step":      step,
+			"enabled_at":     time.Now().Unix(),
+		},
+		"$unset": bson.M{"pending_secret": ""},
+	})
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrTwoFactorNotEnrolling
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return recoveryCodes, nil
+}
+
+//VerifyCode accepts current TOTP code or unused recovery code of profile. TOTP code
+//can't be used twice and recovery code is removed, so intercepted code can't be replayed
+func (service *TwoFactorService) VerifyCode(profileId bson.ObjectId, code string) error {
+
+	state := TwoFactorState{}
+	err := service.twoFactor().Find(bson.M{"_id": profileId, "enabled": true}).One(&state)
+	if err == mgo.ErrNotFound {
+		return ErrTwoFactorNotEnabled
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	code = normalizeCode(code)
+
+	if step := matchTotp(state.Secret, code, time.Now()); step != 0 {
+		err = service.twoFactor().Update(bson.M{"_id": profileId, "last_step": bson.M{"$lt": step}}, bson.M{"$set": bson.M{"last_step": step}})
+	} else {
+		codeHash := hashToken(code)
+		err = service.twoFactor().Update(bson.M{"_id": profileId, "recovery_codes": codeHash}, bson.M{"$pull": bson.M{"recovery_codes": codeHash}})
+	}
+
+	if err == mgo.ErrNotFound {
+		return ErrInvalidTwoFactorCode
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//Disable turns off two-factor authentication, it requires valid code as well
+func (service *TwoFactorService) Disable(profileId bson.ObjectId, code string) error {
+
+	if err := service.VerifyCode(profileId, code); err != nil {
+		return err
+	}
+
+	if err := service.twoFactor().RemoveId(profileId); err != nil && err != mgo.ErrNotFound {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//CreateChallenge starts second step of sign in after password is checked
+func (service *TwoFactorService) CreateChallenge(profile *Profile, device string) (string, error) {
+
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	err = service.challenges().Insert(&LoginChallenge{
+		Id:        bson.NewObjectId(),
+		ProfileId: profile.Id,
+		Email:     profile.Email,
+		TokenHash: hashToken(token),
+		Device:    device,
+		ExpireAt:  time.Now().Add(loginChallengeTtl),
+	})
+
+	if err != nil {
+		return "", ErrStorageError
+	}
+
+	return token, nil
+}
+
+//GetChallenge returns active challenge without counting attempt
+func (service *TwoFactorService) GetChallenge(token string) (*LoginChallenge, error) {
+
+	challenge := LoginChallenge{}
+	err := service.challenges().Find(bson.M{
+		"token_hash": hashToken(token),
+		"attempts":   bson.M{"$lt": loginChallengeAttempts},
+		"expire_at":  bson.M{"$gt": time.Now()},
+	}).One(&challenge)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrInvalidChallenge
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return &challenge, nil
+}
+
+//CompleteChallenge checks code for challenge token and returns completed challenge.
+//Every attempt is counted, challenge is dropped after too many wrong codes.
+//On wrong code challenge is returned with ErrInvalidTwoFactorCode, so failure can be counted for account
+func (service *TwoFactorService) CompleteChallenge(token string, code string) (*LoginChallenge, error) {
+
+	challenge := LoginChallenge{}
+	_, err := service.challenges().Find(bson.M{
+		"token_hash": hashToken(token),
+		"attempts":   bson.M{"$lt": loginChallengeAttempts},
+		"expire_at":  bson.M{"$gt": time.Now()},
+	}).Apply(mgo.Change{Update: bson.M{"$inc": bson.M{"attempts": 1}}, ReturnNew: true}, &challenge)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrInvalidChallenge
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if err := service.VerifyCode(challenge.ProfileId, code); err != nil {
+		switch err {
+		case ErrTwoFactorNotEnabled:
+			return nil, ErrInvalidChallenge
+		case ErrInvalidTwoFactorCode:
+			return &challenge, err
+		default:
+			return nil, err
+		}
+	}
+
+	if err := service.challenges().RemoveId(challenge.Id); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrInvalidChallenge
+		}
+
+		return nil, ErrStorageError
+	}
+
+	return &challenge, nil
+}
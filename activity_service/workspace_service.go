@@ -0,0 +1,470 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//roles of workspace members, each role can do everything lower one can
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleViewer = "viewer"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleMember: 2, RoleAdmin: 3, RoleOwner: 4}
+
+//workspaceInviteTtl is how long emailed invitation can be accepted
+const workspaceInviteTtl = 7 * 24 * time.Hour
+
+func roleAtLeast(role string, minRole string) bool {
+	return roleRanks[role] >= roleRanks[minRole]
+}
+
+//canManage tells whether actor may change or remove member with role, and grant newRole.
+//Owner manages everyone else, admin manages only members and viewers
+func canManage(actor *WorkspaceMember, role string, newRole string) bool {
+
+	if role == RoleOwner || newRole == RoleOwner {
+		return false
+	}
+
+	if actor.Role == RoleOwner {
+		return true
+	}
+
+	return actor.Role == RoleAdmin && !roleAtLeast(role, RoleAdmin) && !roleAtLeast(newRole, RoleAdmin)
+}
+
+//WorkspaceService groups profiles into teams. Activities optionally belong to workspace,
+//admins can read activities and reports of members within workspace
+type WorkspaceService struct {
+	storage *MongoDbStorage
+}
+
+func (service *WorkspaceService) collection(name string) *mgo.Collection {
+	dbStorage := service.storage
+	return dbStorage.mgoSession.DB(dbStorage.dbName).C(name)
+}
+
+func (service *WorkspaceService) EnsureIndexes() error {
+
+	indexes := map[string][]mgo.Index{
+		"workspace_members": {
+			{Key: []string{"workspace_id", "profile_id"}, Unique: true, Background: true},
+			{Key: []string{"profile_id"}, Background: true},
+		},
+		"workspace_invites": {
+			{Key: []string{"token_hash"}, Unique: true, Background: true},
+			{Key: []string{"workspace_id", "email"}, Unique: true, Background: true},
+			{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true},
+		},
+		"activities": {
+			{Key: []string{"workspace_id", "profile_id"}, Sparse: true, Background: true},
+		},
+	}
+
+	for collectionName, collectionIndexes := range indexes {
+		for _, index := range collectionIndexes {
+			if err := service.collection(collectionName).EnsureIndex(index); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (service *WorkspaceService) CreateWorkspace(ownerId bson.ObjectId, name string) (*Workspace, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrBadHttpRequestBody
+	}
+
+	now := time.Now().Unix()
+	workspace := &Workspace{Id: bson.NewObjectId(), Name: name, OwnerId: ownerId, CreatedAt: now}
+
+	if err := service.collection("workspaces").Insert(workspace); err != nil {
+		return nil, ErrStorageError
+	}
+
+	owner := &WorkspaceMember{Id: bson.NewObjectId(), WorkspaceId: workspace.Id, ProfileId: ownerId, Role: RoleOwner, JoinedAt: now}
+	if err := service.collection("workspace_members").Insert(owner); err != nil {
+		service.collection("workspaces").RemoveId(workspace.Id)
+		return nil, ErrStorageError
+	}
+
+	return workspace, nil
+}
+
+//ListWorkspaces returns workspaces of profile with its role in each
+func (service *WorkspaceService) ListWorkspaces(profileId bson.ObjectId) ([]WorkspaceMembership, error) {
+
+	memberships := []WorkspaceMember{}
+	if err := service.collection("workspace_members").Find(bson.M{"profile_id": profileId}).All(&memberships); err != nil {
+		return nil, ErrStorageError
+	}
+
+	workspaceIds := []bson.ObjectId{}
+	roles := map[bson.ObjectId]string{}
+	for _, membership := range memberships {
+		workspaceIds = append(workspaceIds, membership.WorkspaceId)
+		roles[membership.WorkspaceId] = membership.Role
+	}
+
+	workspaces := []Workspace{}
+	if err := service.collection("workspaces").Find(bson.M{"_id": bson.M{"$in": workspaceIds}}).Sort("name").All(&workspaces); err != nil {
+		return nil, ErrStorageError
+	}
+
+	result := []WorkspaceMembership{}
+	for _, workspace := range workspaces {
+		result = append(result, WorkspaceMembership{Workspace: workspace, Role: roles[workspace.Id]})
+	}
+
+	return result, nil
+}
+
+//RequireRole returns membership of profile with at least minRole. Workspaces of other
+//teams are reported as not existing, members with lower role get ErrForbidden
+func (service *WorkspaceService) RequireRole(workspaceId string, profileId bson.ObjectId, minRole string) (*WorkspaceMember, error) {
+
+	if !bson.IsObjectIdHex(workspaceId) {
+		return nil, ErrNotExists
+	}
+
+	member := WorkspaceMember{}
+	err := service.collection("workspace_members").Find(bson.M{"workspace_id": bson.ObjectIdHex(workspaceId), "profile_id": profileId}).One(&member)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotExists
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if !roleAtLeast(member.Role, minRole) {
+		return nil, ErrForbidden
+	}
+
+	return &member, nil
+}
+
+//ReadableProfile extends AuthContext.OwnProfile: other profile is readable when workspace
+//is requested, caller is its admin and requested profile is its member. Callers must
+//restrict data of other profile to this workspace
+func (service *WorkspaceService) ReadableProfile(auth *AuthContext, requestedId string, workspaceId string) (string, error) {
+
+	if profileId, err := auth.OwnProfile(requestedId); err == nil {
+		return profileId, nil
+	}
+
+	if workspaceId == "" || !bson.IsObjectIdHex(requestedId) {
+		return "", ErrForbidden
+	}
+
+	if _, err := service.RequireRole(workspaceId, auth.ProfileId, RoleAdmin); err != nil {
+		if err == ErrStorageError {
+			return "", err
+		}
+
+		return "", ErrForbidden
+	}
+
+	if _, err := service.RequireRole(workspaceId, bson.ObjectIdHex(requestedId), RoleViewer); err != nil {
+		if err == ErrStorageError {
+			return "", err
+		}
+
+		return "", ErrForbidden
+	}
+
+	return requestedId, nil
+}
+
+//CheckActivityWorkspace allows to share activity with workspace only to its members, viewers only read
+func (service *WorkspaceService) CheckActivityWorkspace(profileId bson.ObjectId, workspaceId bson.ObjectId) error {
+
+	if workspaceId == "" {
+		return nil
+	}
+
+	_, err := service.RequireRole(workspaceId.Hex(), profileId, RoleMember)
+	if err == ErrNotExists {
+		return ErrForbidden
+	}
+
+	return err
+}
+
+func (service *WorkspaceService) ListMembers(workspaceId bson.ObjectId) ([]WorkspaceMemberInfo, error) {
+
+	members := []WorkspaceMember{}
+	if err := service.collection("workspace_members").Find(bson.M{"workspace_id": workspaceId}).Sort("joined_at").All(&members); err != nil {
+		return nil, ErrStorageError
+	}
+
+	profileIds := []bson.ObjectId{}
+	for _, member := range members {
+		profileIds = append(profileIds, member.ProfileId)
+	}
+
+	profiles := []Profile{}
+	if err := service.collection("profiles").Find(bson.M{"_id": bson.M{"$in": profileIds}}).Select(bson.M{"email": 1, "username": 1}).All(&profiles); err != nil {
+		return nil, ErrStorageError
+	}
+
+	profilesById := map[bson.ObjectId]Profile{}
+	for _, profile := range profiles {
+		profilesById[profile.Id] = profile
+	}
+
+	result := []WorkspaceMemberInfo{}
+	for _, member := range members {
+		result = append(result, WorkspaceMemberInfo{
+			ProfileId: member.ProfileId,
+			Email:     profilesById[member.ProfileId].Email,
+			UserName:  profilesById[member.ProfileId].UserName,
+			Role:      member.Role,
+			JoinedAt:  member.JoinedAt,
+		})
+	}
+
+	return result, nil
+}
+
+func (service *WorkspaceService) ChangeRole(actor *WorkspaceMember, profileId string, role string) error {
+
+	if _, ok := roleRanks[role]; !ok {
+		return ErrBadRole
+	}
+
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrNotExists
+	}
+
+	target, err := service.RequireRole(actor.WorkspaceId.Hex(), bson.ObjectIdHex(profileId), RoleViewer)
+	if err != nil {
+		return err
+	}
+
+	if target.ProfileId == actor.ProfileId || !canManage(actor, target.Role, role) {
+		return ErrForbidden
+	}
+
+	//role is compared on update, so concurrent change by other admin isn't overwritten
+	err = service.collection("workspace_members").Update(bson.M{"_id": target.Id, "role": target.Role}, bson.M{"$set": bson.M{"role": role}})
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//RemoveMember removes member by admin, or leaves workspace when actor removes itself.
+//Owner can't leave, workspace has to be deleted instead
+func (service *WorkspaceService) RemoveMember(actor *WorkspaceMember, profileId string) error {
+
+	if !bson.IsObjectIdHex(profileId) {
+		return ErrNotExists
+	}
+
+	target, err := service.RequireRole(actor.WorkspaceId.Hex(), bson.ObjectIdHex(profileId), RoleViewer)
+	if err != nil {
+		return err
+	}
+
+	leaving := target.ProfileId == actor.ProfileId
+	if (leaving && target.Role == RoleOwner) || (!leaving && !canManage(actor, target.Role, RoleViewer)) {
+		return ErrForbidden
+	}
+
+	err = service.collection("workspace_members").Remove(bson.M{"_id": target.Id, "role": target.Role})
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//DeleteWorkspace removes workspace with members and invites, activities stay with their owners
+func (service *WorkspaceService) DeleteWorkspace(workspaceId bson.ObjectId) error {
+
+	if err := service.collection("workspaces").RemoveId(workspaceId); err != nil {
+		if err == mgo.ErrNotFound {
+			return ErrNotExists
+		}
+
+		return ErrStorageError
+	}
+
+	if _, err := service.collection("workspace_members").RemoveAll(bson.M{"workspace_id": workspaceId}); err != nil {
+		return ErrStorageError
+	}
+
+	if _, err := service.collection("workspace_invites").RemoveAll(bson.M{"workspace_id": workspaceId}); err != nil {
+		return ErrStorageError
+	}
+
+	if _, err := service.collection("activities").UpdateAll(bson.M{"workspace_id": workspaceId}, bson.M{"$unset": bson.M{"workspace_id": ""}}); err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+func (service *WorkspaceService) GetWorkspace(workspaceId bson.ObjectId) (*Workspace, error) {
+
+	workspace := Workspace{}
+	err := service.collection("workspaces").FindId(workspaceId).One(&workspace)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotExists
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return &workspace, nil
+}
+
+//CreateInvite issues invitation of email to workspace, repeated invitation of
+//the same email replaces previous one. Token is returned once to be mailed
+func (service *WorkspaceService) CreateInvite(actor *WorkspaceMember, request *WorkspaceInviteRequest) (*WorkspaceInvite, string, error) {
+
+	email := strings.TrimSpace(request.Email)
+	if err := validateEmail(email); err != nil {
+		return nil, "", err
+	}
+
+	if _, ok := roleRanks[request.Role]; !ok {
+		return nil, "", ErrBadRole
+	}
+
+	if !canManage(actor, RoleViewer, request.Role) {
+		return nil, "", ErrForbidden
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	invite := WorkspaceInvite{}
+	_, err = service.collection("workspace_invites").Find(bson.M{"workspace_id": actor.WorkspaceId, "email": email}).Apply(mgo.Change{
+		Update: bson.M{
+			"$set": bson.M{
+				"role":       request.Role,
+				"token_hash": hashToken(token),
+				"invited_by": actor.ProfileId,
+				"created_at": now.Unix(),
+				"expire_at":  now.Add(workspaceInviteTtl),
+			},
+			"$setOnInsert": bson.M{"_id": bson.NewObjectId()},
+		},
+		Upsert:    true,
+		ReturnNew: true,
+	}, &invite)
+
+	if err != nil {
+		return nil, "", ErrStorageError
+	}
+
+	return &invite, token, nil
+}
+
+func (service *WorkspaceService) ListInvites(workspaceId bson.ObjectId) ([]WorkspaceInvite, error) {
+
+	invites := []WorkspaceInvite{}
+	err := service.collection("workspace_invites").Find(bson.M{
+		"workspace_id": workspaceId,
+		"expire_at":    bson.M{"$gt": time.Now()},
+	}).Sort("-created_at").All(&invites)
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return invites, nil
+}
+
+func (service *WorkspaceService) RevokeInvite(workspaceId bson.ObjectId, inviteId string) error {
+
+	if !bson.IsObjectIdHex(inviteId) {
+		return ErrNotExists
+	}
+
+	err := service.collection("workspace_invites").Remove(bson.M{"_id": bson.ObjectIdHex(inviteId), "workspace_id": workspaceId})
+	if err == mgo.ErrNotFound {
+		return ErrNotExists
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//AcceptInvite adds profile to workspace. Invitation is bound to email, so it can
+//be accepted only by profile with the same verified email
+func (service *WorkspaceService) AcceptInvite(profile *Profile, token string) (*WorkspaceMembership, error) {
+
+	invitesCollection := service.collection("workspace_invites")
+
+	invite := WorkspaceInvite{}
+	err := invitesCollection.Find(bson.M{"token_hash": hashToken(token), "expire_at": bson.M{"$gt": time.Now()}}).One(&invite)
+	if err == mgo.ErrNotFound {
+		return nil, ErrInvalidInvite
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if !profile.EmailVerified || !strings.EqualFold(profile.Email, invite.Email) {
+		return nil, ErrInviteEmailMismatch
+	}
+
+	workspace, err := service.GetWorkspace(invite.WorkspaceId)
+	if err != nil {
+		return nil, err
+	}
+
+	member := &WorkspaceMember{
+		Id:          bson.NewObjectId(),
+		WorkspaceId: invite.WorkspaceId,
+		ProfileId:   profile.Id,
+		Role:        invite.Role,
+		JoinedAt:    time.Now().Unix(),
+	}
+
+	err = service.collection("workspace_members").Insert(member)
+	if mgo.IsDup(err) {
+		return nil, ErrAlreadyExists
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	if err := invitesCollection.RemoveId(invite.Id); err != nil && err != mgo.ErrNotFound {
+		return nil, ErrStorageError
+	}
+
+	return &WorkspaceMembership{Workspace: *workspace, Role: member.Role}, nil
+}
@@ -3,13 +3,14 @@
 
 package api
 
-import proto "github.com/golang/protobuf/proto"
-import fmt "fmt"
-import math "math"
-
 import (
-	context "golang.org/x/net/context"
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
 	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
 )
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -21,7 +22,7 @@ var _ = math.Inf
 // is compatible with the proto package it is being compiled against.
 // A compilation error at this line likely means your copy of the
 // proto package needs to be updated.
-const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
 type SendMailStatus int32
 
@@ -34,6 +35,7 @@ var SendMailStatus_name = map[int32]string{
 	0: "MailQueuedSuccess",
 	1: "MailQueuedFailed",
 }
+
 var SendMailStatus_value = map[string]int32{
 	"MailQueuedSuccess": 0,
 	"MailQueuedFailed":  1,
@@ -42,12 +44,49 @@ var SendMailStatus_value = map[string]int32{
 func (x SendMailStatus) String() string {
 	return proto.EnumName(SendMailStatus_name, int32(x))
 }
+
 func (SendMailStatus) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_mail_1f3aed1a7aa89c61, []int{0}
+	return fileDescriptor_7cda5f053e74676b, []int{0}
+}
+
+type MailDeliveryStatus int32
+
+const (
+	MailDeliveryStatus_MailPending   MailDeliveryStatus = 0
+	MailDeliveryStatus_MailDelivered MailDeliveryStatus = 1
+	MailDeliveryStatus_MailFailed    MailDeliveryStatus = 2
+)
+
+var MailDeliveryStatus_name = map[int32]string{
+	0: "MailPending",
+	1: "MailDelivered",
+	2: "MailFailed",
+}
+
+var MailDeliveryStatus_value = map[string]int32{
+	"MailPending":   0,
+	"MailDelivered": 1,
+	"MailFailed":    2,
+}
+
+func (x MailDeliveryStatus) String() string {
+	return proto.EnumName(MailDeliveryStatus_name, int32(x))
+}
+
+func (MailDeliveryStatus) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{1}
 }
 
 type SendMailRequest struct {
-	Body                 string   `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
+	Body     string   `protobuf:"bytes,1,opt,name=body,proto3" json:"body,omitempty"`
+	To       []string `protobuf:"bytes,2,rep,name=to,proto3" json:"to,omitempty"`
+	Subject  string   `protobuf:"bytes,3,opt,name=subject,proto3" json:"subject,omitempty"`
+	HtmlBody string   `protobuf:"bytes,4,opt,name=html_body,json=htmlBody,proto3" json:"html_body,omitempty"`
+	// template_name selects registered template, body and subject are rendered from it
+	TemplateName string            `protobuf:"bytes,5,opt,name=template_name,json=templateName,proto3" json:"template_name,omitempty"`
+	TemplateVars map[string]string `protobuf:"bytes,6,rep,name=template_vars,json=templateVars,proto3" json:"template_vars,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// requests with the same idempotency_key are queued only once
+	IdempotencyKey       string   `protobuf:"bytes,7,opt,name=idempotency_key,json=idempotencyKey,proto3" json:"idempotency_key,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -57,16 +96,17 @@ func (m *SendMailRequest) Reset()         { *m = SendMailRequest{} }
 func (m *SendMailRequest) String() string { return proto.CompactTextString(m) }
 func (*SendMailRequest) ProtoMessage()    {}
 func (*SendMailRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_mail_1f3aed1a7aa89c61, []int{0}
+	return fileDescriptor_7cda5f053e74676b, []int{0}
 }
+
 func (m *SendMailRequest) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_SendMailRequest.Unmarshal(m, b)
 }
 func (m *SendMailRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_SendMailRequest.Marshal(b, m, deterministic)
 }
-func (dst *SendMailRequest) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_SendMailRequest.Merge(dst, src)
+func (m *SendMailRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendMailRequest.Merge(m, src)
 }
 func (m *SendMailRequest) XXX_Size() int {
 	return xxx_messageInfo_SendMailRequest.Size(m)
@@ -84,8 +124,52 @@ func (m *SendMailRequest) GetBody() string {
 	return ""
 }
 
+func (m *SendMailRequest) GetTo() []string {
+	if m != nil {
+		return m.To
+	}
+	return nil
+}
+
+func (m *SendMailRequest) GetSubject() string {
+	if m != nil {
+		return m.Subject
+	}
+	return ""
+}
+
+func (m *SendMailRequest) GetHtmlBody() string {
+	if m != nil {
+		return m.HtmlBody
+	}
+	return ""
+}
+
+func (m *SendMailRequest) GetTemplateName() string {
+	if m != nil {
+		return m.TemplateName
+	}
+	return ""
+}
+
+func (m *SendMailRequest) GetTemplateVars() map[string]string {
+	if m != nil {
+		return m.TemplateVars
+	}
+	return nil
+}
+
+func (m *SendMailRequest) GetIdempotencyKey() string {
+	if m != nil {
+		return m.IdempotencyKey
+	}
+	return ""
+}
+
 type SendMailResponse struct {
 	SendStatus           SendMailStatus `protobuf:"varint,1,opt,name=send_status,json=sendStatus,proto3,enum=api.SendMailStatus" json:"send_status,omitempty"`
+	MessageId            string         `protobuf:"bytes,2,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Reason               string         `protobuf:"bytes,3,opt,name=reason,proto3" json:"reason,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}       `json:"-"`
 	XXX_unrecognized     []byte         `json:"-"`
 	XXX_sizecache        int32          `json:"-"`
@@ -95,16 +179,17 @@ func (m *SendMailResponse) Reset()         { *m = SendMailResponse{} }
 func (m *SendMailResponse) String() string { return proto.CompactTextString(m) }
 func (*SendMailResponse) ProtoMessage()    {}
 func (*SendMailResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_mail_1f3aed1a7aa89c61, []int{1}
+	return fileDescriptor_7cda5f053e74676b, []int{1}
 }
+
 func (m *SendMailResponse) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_SendMailResponse.Unmarshal(m, b)
 }
 func (m *SendMailResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
 	return xxx_messageInfo_SendMailResponse.Marshal(b, m, deterministic)
 }
-func (dst *SendMailResponse) XXX_Merge(src proto.Message) {
-	xxx_messageInfo_SendMailResponse.Merge(dst, src)
+func (m *SendMailResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SendMailResponse.Merge(m, src)
 }
 func (m *SendMailResponse) XXX_Size() int {
 	return xxx_messageInfo_SendMailResponse.Size(m)
@@ -122,10 +207,427 @@ func (m *SendMailResponse) GetSendStatus() SendMailStatus {
 	return SendMailStatus_MailQueuedSuccess
 }
 
+func (m *SendMailResponse) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
+func (m *SendMailResponse) GetReason() string {
+	if m != nil {
+		return m.Reason
+	}
+	return ""
+}
+
+type GetMailStatusRequest struct {
+	MessageId            string   `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetMailStatusRequest) Reset()         { *m = GetMailStatusRequest{} }
+func (m *GetMailStatusRequest) String() string { return proto.CompactTextString(m) }
+func (*GetMailStatusRequest) ProtoMessage()    {}
+func (*GetMailStatusRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{2}
+}
+
+func (m *GetMailStatusRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetMailStatusRequest.Unmarshal(m, b)
+}
+func (m *GetMailStatusRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetMailStatusRequest.Marshal(b, m, deterministic)
+}
+func (m *GetMailStatusRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetMailStatusRequest.Merge(m, src)
+}
+func (m *GetMailStatusRequest) XXX_Size() int {
+	return xxx_messageInfo_GetMailStatusRequest.Size(m)
+}
+func (m *GetMailStatusRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetMailStatusRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetMailStatusRequest proto.InternalMessageInfo
+
+func (m *GetMailStatusRequest) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
+type GetMailStatusResponse struct {
+	MessageId            string             `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	Status               MailDeliveryStatus `protobuf:"varint,2,opt,name=status,proto3,enum=api.MailDeliveryStatus" json:"status,omitempty"`
+	Error                string             `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}           `json:"-"`
+	XXX_unrecognized     []byte             `json:"-"`
+	XXX_sizecache        int32              `json:"-"`
+}
+
+func (m *GetMailStatusResponse) Reset()         { *m = GetMailStatusResponse{} }
+func (m *GetMailStatusResponse) String() string { return proto.CompactTextString(m) }
+func (*GetMailStatusResponse) ProtoMessage()    {}
+func (*GetMailStatusResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{3}
+}
+
+func (m *GetMailStatusResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetMailStatusResponse.Unmarshal(m, b)
+}
+func (m *GetMailStatusResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetMailStatusResponse.Marshal(b, m, deterministic)
+}
+func (m *GetMailStatusResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetMailStatusResponse.Merge(m, src)
+}
+func (m *GetMailStatusResponse) XXX_Size() int {
+	return xxx_messageInfo_GetMailStatusResponse.Size(m)
+}
+func (m *GetMailStatusResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetMailStatusResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetMailStatusResponse proto.InternalMessageInfo
+
+func (m *GetMailStatusResponse) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
+func (m *GetMailStatusResponse) GetStatus() MailDeliveryStatus {
+	if m != nil {
+		return m.Status
+	}
+	return MailDeliveryStatus_MailPending
+}
+
+func (m *GetMailStatusResponse) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+type DeadLetter struct {
+	MessageId            string   `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	To                   []string `protobuf:"bytes,2,rep,name=to,proto3" json:"to,omitempty"`
+	Subject              string   `protobuf:"bytes,3,opt,name=subject,proto3" json:"subject,omitempty"`
+	Attempts             int32    `protobuf:"varint,4,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	LastError            string   `protobuf:"bytes,5,opt,name=last_error,json=lastError,proto3" json:"last_error,omitempty"`
+	FailedAt             int64    `protobuf:"varint,6,opt,name=failed_at,json=failedAt,proto3" json:"failed_at,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeadLetter) Reset()         { *m = DeadLetter{} }
+func (m *DeadLetter) String() string { return proto.CompactTextString(m) }
+func (*DeadLetter) ProtoMessage()    {}
+func (*DeadLetter) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{4}
+}
+
+func (m *DeadLetter) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeadLetter.Unmarshal(m, b)
+}
+func (m *DeadLetter) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeadLetter.Marshal(b, m, deterministic)
+}
+func (m *DeadLetter) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeadLetter.Merge(m, src)
+}
+func (m *DeadLetter) XXX_Size() int {
+	return xxx_messageInfo_DeadLetter.Size(m)
+}
+func (m *DeadLetter) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeadLetter.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeadLetter proto.InternalMessageInfo
+
+func (m *DeadLetter) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
+func (m *DeadLetter) GetTo() []string {
+	if m != nil {
+		return m.To
+	}
+	return nil
+}
+
+func (m *DeadLetter) GetSubject() string {
+	if m != nil {
+		return m.Subject
+	}
+	return ""
+}
+
+func (m *DeadLetter) GetAttempts() int32 {
+	if m != nil {
+		return m.Attempts
+	}
+	return 0
+}
+
+func (m *DeadLetter) GetLastError() string {
+	if m != nil {
+		return m.LastError
+	}
+	return ""
+}
+
+func (m *DeadLetter) GetFailedAt() int64 {
+	if m != nil {
+		return m.FailedAt
+	}
+	return 0
+}
+
+type ListDeadLettersRequest struct {
+	Limit                int32    `protobuf:"varint,1,opt,name=limit,proto3" json:"limit,omitempty"`
+	Offset               int32    `protobuf:"varint,2,opt,name=offset,proto3" json:"offset,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListDeadLettersRequest) Reset()         { *m = ListDeadLettersRequest{} }
+func (m *ListDeadLettersRequest) String() string { return proto.CompactTextString(m) }
+func (*ListDeadLettersRequest) ProtoMessage()    {}
+func (*ListDeadLettersRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{5}
+}
+
+func (m *ListDeadLettersRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListDeadLettersRequest.Unmarshal(m, b)
+}
+func (m *ListDeadLettersRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListDeadLettersRequest.Marshal(b, m, deterministic)
+}
+func (m *ListDeadLettersRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListDeadLettersRequest.Merge(m, src)
+}
+func (m *ListDeadLettersRequest) XXX_Size() int {
+	return xxx_messageInfo_ListDeadLettersRequest.Size(m)
+}
+func (m *ListDeadLettersRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListDeadLettersRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListDeadLettersRequest proto.InternalMessageInfo
+
+func (m *ListDeadLettersRequest) GetLimit() int32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *ListDeadLettersRequest) GetOffset() int32 {
+	if m != nil {
+		return m.Offset
+	}
+	return 0
+}
+
+type ListDeadLettersResponse struct {
+	DeadLetters          []*DeadLetter `protobuf:"bytes,1,rep,name=dead_letters,json=deadLetters,proto3" json:"dead_letters,omitempty"`
+	Total                int32         `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}      `json:"-"`
+	XXX_unrecognized     []byte        `json:"-"`
+	XXX_sizecache        int32         `json:"-"`
+}
+
+func (m *ListDeadLettersResponse) Reset()         { *m = ListDeadLettersResponse{} }
+func (m *ListDeadLettersResponse) String() string { return proto.CompactTextString(m) }
+func (*ListDeadLettersResponse) ProtoMessage()    {}
+func (*ListDeadLettersResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{6}
+}
+
+func (m *ListDeadLettersResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListDeadLettersResponse.Unmarshal(m, b)
+}
+func (m *ListDeadLettersResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListDeadLettersResponse.Marshal(b, m, deterministic)
+}
+func (m *ListDeadLettersResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListDeadLettersResponse.Merge(m, src)
+}
+func (m *ListDeadLettersResponse) XXX_Size() int {
+	return xxx_messageInfo_ListDeadLettersResponse.Size(m)
+}
+func (m *ListDeadLettersResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListDeadLettersResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListDeadLettersResponse proto.InternalMessageInfo
+
+func (m *ListDeadLettersResponse) GetDeadLetters() []*DeadLetter {
+	if m != nil {
+		return m.DeadLetters
+	}
+	return nil
+}
+
+func (m *ListDeadLettersResponse) GetTotal() int32 {
+	if m != nil {
+		return m.Total
+	}
+	return 0
+}
+
+type ReplayDeadLetterRequest struct {
+	MessageId            string   `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReplayDeadLetterRequest) Reset()         { *m = ReplayDeadLetterRequest{} }
+func (m *ReplayDeadLetterRequest) String() string { return proto.CompactTextString(m) }
+func (*ReplayDeadLetterRequest) ProtoMessage()    {}
+func (*ReplayDeadLetterRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{7}
+}
+
+func (m *ReplayDeadLetterRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReplayDeadLetterRequest.Unmarshal(m, b)
+}
+func (m *ReplayDeadLetterRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReplayDeadLetterRequest.Marshal(b, m, deterministic)
+}
+func (m *ReplayDeadLetterRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReplayDeadLetterRequest.Merge(m, src)
+}
+func (m *ReplayDeadLetterRequest) XXX_Size() int {
+	return xxx_messageInfo_ReplayDeadLetterRequest.Size(m)
+}
+func (m *ReplayDeadLetterRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReplayDeadLetterRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReplayDeadLetterRequest proto.InternalMessageInfo
+
+func (m *ReplayDeadLetterRequest) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
+type ReplayDeadLetterResponse struct {
+	MessageId            string   `protobuf:"bytes,1,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReplayDeadLetterResponse) Reset()         { *m = ReplayDeadLetterResponse{} }
+func (m *ReplayDeadLetterResponse) String() string { return proto.CompactTextString(m) }
+func (*ReplayDeadLetterResponse) ProtoMessage()    {}
+func (*ReplayDeadLetterResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_7cda5f053e74676b, []int{8}
+}
+
+func (m *ReplayDeadLetterResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReplayDeadLetterResponse.Unmarshal(m, b)
+}
+func (m *ReplayDeadLetterResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReplayDeadLetterResponse.Marshal(b, m, deterministic)
+}
+func (m *ReplayDeadLetterResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReplayDeadLetterResponse.Merge(m, src)
+}
+func (m *ReplayDeadLetterResponse) XXX_Size() int {
+	return xxx_messageInfo_ReplayDeadLetterResponse.Size(m)
+}
+func (m *ReplayDeadLetterResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReplayDeadLetterResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReplayDeadLetterResponse proto.InternalMessageInfo
+
+func (m *ReplayDeadLetterResponse) GetMessageId() string {
+	if m != nil {
+		return m.MessageId
+	}
+	return ""
+}
+
 func init() {
+	proto.RegisterEnum("api.SendMailStatus", SendMailStatus_name, SendMailStatus_value)
+	proto.RegisterEnum("api.MailDeliveryStatus", MailDeliveryStatus_name, MailDeliveryStatus_value)
 	proto.RegisterType((*SendMailRequest)(nil), "api.SendMailRequest")
+	proto.RegisterMapType((map[string]string)(nil), "api.SendMailRequest.TemplateVarsEntry")
 	proto.RegisterType((*SendMailResponse)(nil), "api.SendMailResponse")
-	proto.RegisterEnum("api.SendMailStatus", SendMailStatus_name, SendMailStatus_value)
+	proto.RegisterType((*GetMailStatusRequest)(nil), "api.GetMailStatusRequest")
+	proto.RegisterType((*GetMailStatusResponse)(nil), "api.GetMailStatusResponse")
+	proto.RegisterType((*DeadLetter)(nil), "api.DeadLetter")
+	proto.RegisterType((*ListDeadLettersRequest)(nil), "api.ListDeadLettersRequest")
+	proto.RegisterType((*ListDeadLettersResponse)(nil), "api.ListDeadLettersResponse")
+	proto.RegisterType((*ReplayDeadLetterRequest)(nil), "api.ReplayDeadLetterRequest")
+	proto.RegisterType((*ReplayDeadLetterResponse)(nil), "api.ReplayDeadLetterResponse")
+}
+
+func init() { proto.RegisterFile("mail.proto", fileDescriptor_7cda5f053e74676b) }
+
+var fileDescriptor_7cda5f053e74676b = []byte{
+	// 678 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x55, 0xdb, 0x6e, 0xd3, 0x40,
+	0x10, 0xad, 0x9d, 0x26, 0x4d, 0x26, 0x6d, 0xe2, 0x2e, 0x69, 0x6b, 0x5c, 0x2a, 0x45, 0x46, 0x82,
+	0xa8, 0x0f, 0x41, 0x0a, 0x20, 0xb5, 0x48, 0x08, 0x81, 0xda, 0x52, 0xd4, 0x52, 0x51, 0x07, 0xf1,
+	0x6a, 0x6d, 0xe3, 0x69, 0x31, 0xf5, 0x0d, 0xef, 0x3a, 0x92, 0x1f, 0x10, 0x5f, 0xc4, 0x23, 0xff,
+	0xc0, 0x67, 0xa1, 0x5d, 0x6f, 0xee, 0x29, 0xf4, 0x6d, 0xe7, 0xcc, 0xcc, 0x99, 0xdb, 0x71, 0x02,
+	0x10, 0x52, 0x3f, 0xe8, 0x26, 0x69, 0xcc, 0x63, 0x52, 0xa2, 0x89, 0x6f, 0xff, 0xd1, 0xa1, 0xd9,
+	0xc7, 0xc8, 0xfb, 0x48, 0xfd, 0xc0, 0xc1, 0xef, 0x19, 0x32, 0x4e, 0x08, 0xac, 0x5e, 0xc5, 0x5e,
+	0x6e, 0x6a, 0x6d, 0xad, 0x53, 0x73, 0xe4, 0x9b, 0x34, 0x40, 0xe7, 0xb1, 0xa9, 0xb7, 0x4b, 0x9d,
+	0x9a, 0xa3, 0xf3, 0x98, 0x98, 0xb0, 0xc6, 0xb2, 0xab, 0x6f, 0x38, 0xe0, 0x66, 0x49, 0x86, 0x8d,
+	0x4c, 0xb2, 0x0b, 0xb5, 0xaf, 0x3c, 0x0c, 0x5c, 0x49, 0xb1, 0x2a, 0x7d, 0x55, 0x01, 0xbc, 0x13,
+	0x34, 0x8f, 0x61, 0x83, 0x63, 0x98, 0x04, 0x94, 0xa3, 0x1b, 0xd1, 0x10, 0xcd, 0xb2, 0x0c, 0x58,
+	0x1f, 0x81, 0x17, 0x34, 0x44, 0x72, 0x36, 0x15, 0x34, 0xa4, 0x29, 0x33, 0x2b, 0xed, 0x52, 0xa7,
+	0xde, 0x7b, 0xd2, 0xa5, 0x89, 0xdf, 0x9d, 0x6b, 0xb6, 0xfb, 0x59, 0x45, 0x7e, 0xa1, 0x29, 0x3b,
+	0x8e, 0x78, 0x9a, 0x4f, 0xc8, 0x04, 0x44, 0x9e, 0x42, 0xd3, 0xf7, 0x30, 0x4c, 0x62, 0x8e, 0xd1,
+	0x20, 0x77, 0x6f, 0x31, 0x37, 0xd7, 0x64, 0xcd, 0xc6, 0x14, 0x7c, 0x86, 0xb9, 0xf5, 0x06, 0x36,
+	0x17, 0xb8, 0x88, 0x01, 0xa5, 0x5b, 0x1c, 0x6d, 0x42, 0x3c, 0x49, 0x0b, 0xca, 0x43, 0x1a, 0x64,
+	0x68, 0xea, 0x12, 0x2b, 0x8c, 0x57, 0xfa, 0x81, 0x66, 0xff, 0x04, 0x63, 0xd2, 0x1c, 0x4b, 0xe2,
+	0x88, 0x21, 0x79, 0x01, 0x75, 0x86, 0x91, 0xe7, 0x32, 0x4e, 0x79, 0xc6, 0x24, 0x4f, 0xa3, 0xf7,
+	0x60, 0x66, 0x90, 0xbe, 0x74, 0x39, 0x20, 0xe2, 0x8a, 0x37, 0xd9, 0x03, 0x08, 0x91, 0x31, 0x7a,
+	0x83, 0xae, 0xef, 0xa9, 0x42, 0x35, 0x85, 0x7c, 0xf0, 0xc8, 0x36, 0x54, 0x52, 0xa4, 0x2c, 0x8e,
+	0xd4, 0xea, 0x95, 0x65, 0xbf, 0x84, 0xd6, 0x7b, 0xe4, 0x53, 0x9c, 0xea, 0x9e, 0xb3, 0x74, 0xda,
+	0x1c, 0x9d, 0xfd, 0x03, 0xb6, 0xe6, 0xd2, 0x54, 0xf3, 0xff, 0xce, 0x23, 0xcf, 0xa0, 0xa2, 0xc6,
+	0xd2, 0xe5, 0x58, 0x3b, 0x72, 0x2c, 0xc1, 0x73, 0x84, 0x81, 0x3f, 0xc4, 0x34, 0x57, 0x7c, 0x2a,
+	0x4c, 0xac, 0x0e, 0xd3, 0x34, 0x4e, 0x55, 0xdb, 0x85, 0x61, 0xff, 0xd2, 0x00, 0x8e, 0x90, 0x7a,
+	0xe7, 0xc8, 0x39, 0xa6, 0xff, 0x2b, 0x7a, 0x7f, 0x1d, 0x5a, 0x50, 0xa5, 0x5c, 0x48, 0x81, 0x33,
+	0x29, 0xc3, 0xb2, 0x33, 0xb6, 0x45, 0x91, 0x80, 0x32, 0xee, 0x16, 0xed, 0x14, 0x1a, 0xac, 0x09,
+	0xe4, 0x58, 0x00, 0x42, 0xc2, 0xd7, 0xd4, 0x0f, 0xd0, 0x73, 0x29, 0x37, 0x2b, 0x6d, 0xad, 0x53,
+	0x72, 0xaa, 0x05, 0xf0, 0x96, 0xdb, 0x27, 0xb0, 0x7d, 0xee, 0x33, 0x3e, 0x69, 0x79, 0xbc, 0xe7,
+	0x16, 0x94, 0x03, 0x3f, 0xf4, 0xb9, 0xec, 0xba, 0xec, 0x14, 0x86, 0xb8, 0x56, 0x7c, 0x7d, 0xcd,
+	0x90, 0xcb, 0x35, 0x95, 0x1d, 0x65, 0xd9, 0x03, 0xd8, 0x59, 0xe0, 0x51, 0x8b, 0xef, 0xc1, 0xba,
+	0x87, 0xd4, 0x73, 0x83, 0x02, 0x37, 0x35, 0xa9, 0xff, 0xa6, 0xdc, 0xef, 0x24, 0xde, 0xa9, 0x7b,
+	0x93, 0x5c, 0x51, 0x9c, 0xc7, 0x9c, 0x06, 0xaa, 0x4a, 0x61, 0xd8, 0x07, 0xb0, 0xe3, 0x60, 0x12,
+	0xd0, 0x7c, 0x2a, 0xed, 0x7e, 0xaa, 0x38, 0x04, 0x73, 0x31, 0xf3, 0x5e, 0xc2, 0xd8, 0x7f, 0x0d,
+	0x8d, 0x59, 0x71, 0x93, 0x2d, 0xd8, 0x14, 0xd6, 0x65, 0x86, 0x19, 0x7a, 0xfd, 0x6c, 0x30, 0x40,
+	0xc6, 0x8c, 0x15, 0xd2, 0x02, 0x63, 0x02, 0x9f, 0xc8, 0x05, 0x1b, 0xda, 0xfe, 0x29, 0x90, 0x45,
+	0x11, 0x91, 0x26, 0xd4, 0x05, 0xfa, 0x09, 0x23, 0xcf, 0x8f, 0x6e, 0x8c, 0x15, 0xb2, 0x09, 0x1b,
+	0x53, 0x61, 0x22, 0x93, 0x34, 0x00, 0x04, 0xa4, 0x98, 0xf4, 0xde, 0x6f, 0xbd, 0x48, 0xea, 0x63,
+	0x3a, 0xf4, 0x07, 0x48, 0x0e, 0xa1, 0x3a, 0x6a, 0x8c, 0xb4, 0x96, 0xfd, 0x9a, 0x58, 0x5b, 0x73,
+	0x68, 0x31, 0xb0, 0xbd, 0x42, 0x4e, 0x61, 0x63, 0xe6, 0x23, 0x21, 0x0f, 0x65, 0xe4, 0xb2, 0xef,
+	0xcd, 0xb2, 0x96, 0xb9, 0xc6, 0x4c, 0x17, 0xd0, 0x9c, 0xbb, 0x3b, 0xd9, 0x95, 0x09, 0xcb, 0x55,
+	0x65, 0x3d, 0x5a, 0xee, 0x1c, 0xf3, 0x5d, 0x82, 0x31, 0x7f, 0x28, 0x52, 0xe4, 0xdc, 0x71, 0x79,
+	0x6b, 0xef, 0x0e, 0xef, 0x88, 0xf2, 0xaa, 0x22, 0xff, 0x20, 0x9e, 0xff, 0x1d, 0x00, 0x8a, 0x53,
+	0xe9, 0x03, 0x2e, 0x06, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -141,6 +643,10 @@ const _ = grpc.SupportPackageIsVersion4
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type MailServiceClient interface {
 	SendMail(ctx context.Context, in *SendMailRequest, opts ...grpc.CallOption) (*SendMailResponse, error)
+	GetMailStatus(ctx context.Context, in *GetMailStatusRequest, opts ...grpc.CallOption) (*GetMailStatusResponse, error)
+	// admin methods for messages which exhausted delivery attempts
+	ListDeadLetters(ctx context.Context, in *ListDeadLettersRequest, opts ...grpc.CallOption) (*ListDeadLettersResponse, error)
+	ReplayDeadLetter(ctx context.Context, in *ReplayDeadLetterRequest, opts ...grpc.CallOption) (*ReplayDeadLetterResponse, error)
 }
 
 type mailServiceClient struct {
@@ -160,9 +666,57 @@ func (c *mailServiceClient) SendMail(ctx context.Context, in *SendMailRequest, o
 	return out, nil
 }
 
+func (c *mailServiceClient) GetMailStatus(ctx context.Context, in *GetMailStatusRequest, opts ...grpc.CallOption) (*GetMailStatusResponse, error) {
+	out := new(GetMailStatusResponse)
+	err := c.cc.Invoke(ctx, "/api.MailService/GetMailStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailServiceClient) ListDeadLetters(ctx context.Context, in *ListDeadLettersRequest, opts ...grpc.CallOption) (*ListDeadLettersResponse, error) {
+	out := new(ListDeadLettersResponse)
+	err := c.cc.Invoke(ctx, "/api.MailService/ListDeadLetters", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailServiceClient) ReplayDeadLetter(ctx context.Context, in *ReplayDeadLetterRequest, opts ...grpc.CallOption) (*ReplayDeadLetterResponse, error) {
+	out := new(ReplayDeadLetterResponse)
+	err := c.cc.Invoke(ctx, "/api.MailService/ReplayDeadLetter", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MailServiceServer is the server API for MailService service.
 type MailServiceServer interface {
 	SendMail(context.Context, *SendMailRequest) (*SendMailResponse, error)
+	GetMailStatus(context.Context, *GetMailStatusRequest) (*GetMailStatusResponse, error)
+	// admin methods for messages which exhausted delivery attempts
+	ListDeadLetters(context.Context, *ListDeadLettersRequest) (*ListDeadLettersResponse, error)
+	ReplayDeadLetter(context.Context, *ReplayDeadLetterRequest) (*ReplayDeadLetterResponse, error)
+}
+
+// UnimplementedMailServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedMailServiceServer struct {
+}
+
+func (*UnimplementedMailServiceServer) SendMail(ctx context.Context, req *SendMailRequest) (*SendMailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMail not implemented")
+}
+func (*UnimplementedMailServiceServer) GetMailStatus(ctx context.Context, req *GetMailStatusRequest) (*GetMailStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMailStatus not implemented")
+}
+func (*UnimplementedMailServiceServer) ListDeadLetters(ctx context.Context, req *ListDeadLettersRequest) (*ListDeadLettersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListDeadLetters not implemented")
+}
+func (*UnimplementedMailServiceServer) ReplayDeadLetter(ctx context.Context, req *ReplayDeadLetterRequest) (*ReplayDeadLetterResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplayDeadLetter not implemented")
 }
 
 func RegisterMailServiceServer(s *grpc.Server, srv MailServiceServer) {
@@ -187,6 +741,60 @@ func _MailService_SendMail_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MailService_GetMailStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMailStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailServiceServer).GetMailStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.MailService/GetMailStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailServiceServer).GetMailStatus(ctx, req.(*GetMailStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailService_ListDeadLetters_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListDeadLettersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailServiceServer).ListDeadLetters(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.MailService/ListDeadLetters",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailServiceServer).ListDeadLetters(ctx, req.(*ListDeadLettersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailService_ReplayDeadLetter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplayDeadLetterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailServiceServer).ReplayDeadLetter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.MailService/ReplayDeadLetter",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailServiceServer).ReplayDeadLetter(ctx, req.(*ReplayDeadLetterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _MailService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "api.MailService",
 	HandlerType: (*MailServiceServer)(nil),
@@ -195,26 +803,19 @@ var _MailService_serviceDesc = grpc.ServiceDesc{
 			MethodName: "SendMail",
 			Handler:    _MailService_SendMail_Handler,
 		},
+		{
+			MethodName: "GetMailStatus",
+			Handler:    _MailService_GetMailStatus_Handler,
+		},
+		{
+			MethodName: "ListDeadLetters",
+			Handler:    _MailService_ListDeadLetters_Handler,
+		},
+		{
+			MethodName: "ReplayDeadLetter",
+			Handler:    _MailService_ReplayDeadLetter_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "mail.proto",
 }
-
-func init() { proto.RegisterFile("mail.proto", fileDescriptor_mail_1f3aed1a7aa89c61) }
-
-var fileDescriptor_mail_1f3aed1a7aa89c61 = []byte{
-	// 203 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xca, 0x4d, 0xcc, 0xcc,
-	0xd1, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x4e, 0x2c, 0xc8, 0x54, 0x52, 0xe5, 0xe2, 0x0f,
-	0x4e, 0xcd, 0x4b, 0xf1, 0x4d, 0xcc, 0xcc, 0x09, 0x4a, 0x2d, 0x2c, 0x4d, 0x2d, 0x2e, 0x11, 0x12,
-	0xe2, 0x62, 0x49, 0xca, 0x4f, 0xa9, 0x94, 0x60, 0x54, 0x60, 0xd4, 0xe0, 0x0c, 0x02, 0xb3, 0x95,
-	0x3c, 0xb8, 0x04, 0x10, 0xca, 0x8a, 0x0b, 0xf2, 0xf3, 0x8a, 0x53, 0x85, 0x4c, 0xb8, 0xb8, 0x8b,
-	0x53, 0xf3, 0x52, 0xe2, 0x8b, 0x4b, 0x12, 0x4b, 0x4a, 0x8b, 0xc1, 0xca, 0xf9, 0x8c, 0x84, 0xf5,
-	0x12, 0x0b, 0x32, 0xf5, 0x60, 0x6a, 0x83, 0xc1, 0x52, 0x41, 0x5c, 0x20, 0x75, 0x10, 0xb6, 0x96,
-	0x2d, 0x17, 0x1f, 0xaa, 0xac, 0x90, 0x28, 0x97, 0x20, 0x88, 0x17, 0x58, 0x9a, 0x5a, 0x9a, 0x9a,
-	0x12, 0x5c, 0x9a, 0x9c, 0x9c, 0x5a, 0x5c, 0x2c, 0xc0, 0x20, 0x24, 0xc2, 0x25, 0x80, 0x10, 0x76,
-	0x4b, 0xcc, 0xcc, 0x49, 0x4d, 0x11, 0x60, 0x34, 0xf2, 0xe0, 0xe2, 0x06, 0x6b, 0x4d, 0x2d, 0x2a,
-	0xcb, 0x4c, 0x4e, 0x15, 0xb2, 0xe4, 0xe2, 0x80, 0x99, 0x26, 0x24, 0x82, 0x62, 0x35, 0xd4, 0x37,
-	0x52, 0xa2, 0x68, 0xa2, 0x10, 0xc7, 0x2b, 0x31, 0x24, 0xb1, 0x81, 0x43, 0xc1, 0x18, 0x10, 0x00,
-	0x00, 0xff, 0xff, 0xff, 0xf0, 0x9e, 0xc2, 0x13, 0x01, 0x00, 0x00,
-}
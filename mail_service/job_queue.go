@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/RustamSafiulin/TimeTrackerService/pkg/mail_sender"
+)
+
+//queuePollInterval is how often workers check store for jobs which are due to retry
+const queuePollInterval = time.Second
+
+type QueueConfig struct {
+	Workers int `json:"workers"`
+	//MaxPending is number of undelivered jobs after which new mails are rejected
+	MaxPending int        `json:"max_pending"`
+	RateLimits RateLimits `json:"rate_limits"`
+}
+
+type SendMailJobQueue struct {
+	store      *MailJobStore
+	smtpConfig *mail_sender.Config
+	config     QueueConfig
+	limiter    *RateLimiter
+	wake       chan struct{}
+	stop       chan struct{}
+}
+
+func NewSendMailJobQueue(store *MailJobStore, smtpConfig *mail_sender.Config, config QueueConfig) *SendMailJobQueue {
+	return &SendMailJobQueue{
+		store:      store,
+		smtpConfig: smtpConfig,
+		config:     config,
+		limiter:    NewRateLimiter(config.RateLimits),
+		wake:       make(chan struct{}, config.Workers),
+		stop:       make(chan struct{}),
+	}
+}
+
+//AddTask persists job and wakes worker, it never blocks on workers.
+//ErrQueueSaturated is returned when too many jobs are waiting for delivery
+func (jq *SendMailJobQueue) AddTask(mailJob *MailJob) (messageId string, existed bool, err error) {
+
+	if jq.config.MaxPending > 0 {
+		pending, err := jq.store.PendingCount()
+		if err != nil {
+			return "", false, err
+		}
+
+		if pending >= jq.config.MaxPending {
+			return "", false, ErrQueueSaturated
+		}
+	}
+
+	messageId, existed, err = jq.store.Insert(mailJob)
+	if err != nil || existed {
+		return messageId, existed, err
+	}
+
+	jq.Wake()
+	return messageId, false, nil
+}
+
+func (jq *SendMailJobQueue) Wake() {
+	select {
+	case jq.wake <- struct{}{}:
+	default:
+	}
+}
+
+//RunLoop starts configured number of workers, wg is released by each of them
+func (jq *SendMailJobQueue) RunLoop() {
+
+	for i := 0; i < jq.config.Workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			ticker := time.NewTicker(queuePollInterval)
+			defer ticker.Stop()
+
+			for {
+				jq.drain()
+
+				select {
+				case <-jq.stop:
+					return
+				case <-jq.wake:
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+//drain sends all jobs which are due now
+func (jq *SendMailJobQueue) drain() {
+
+	for {
+		select {
+		case <-jq.stop:
+			return
+		default:
+		}
+
+		job, err := jq.store.Claim()
+		if err == ErrNoJobs {
+			return
+		}
+
+		if err != nil {
+			log.Printf("Failed to claim mail job: %v", err)
+			return
+		}
+
+		jq.process(job)
+	}
+}
+
+func (jq *SendMailJobQueue) process(job *MailJob) {
+
+	for {
+		wait, deferFor := jq.limiter.Reserve(job.To)
+		if deferFor > 0 {
+			if err := jq.store.Defer(job, time.Now().Add(deferFor)); err != nil {
+				log.Printf("Failed to defer mail job %s: %v", job.Id, err)
+			}
+
+			return
+		}
+
+		if wait == 0 {
+			break
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-jq.stop:
+			if err := jq.store.Defer(job, time.Now()); err != nil {
+				log.Printf("Failed to defer mail job %s: %v", job.Id, err)
+			}
+
+			return
+		}
+	}
+
+	if err := mail_sender.Send(jq.smtpConfig, job.SenderRequest()); err != nil {
+		log.Printf("Failed to send mail %s to %v (attempt %d): %v", job.Id, job.To, job.Attempts+1, err)
+		if err := jq.store.MarkFailed(job, err); err != nil {
+			log.Printf("Failed to update mail job %s: %v", job.Id, err)
+		}
+
+		return
+	}
+
+	if err := jq.store.MarkDelivered(job); err != nil {
+		log.Printf("Failed to update mail job %s: %v", job.Id, err)
+	}
+}
+
+func (jq *SendMailJobQueue) Stop() {
+	close(jq.stop)
+}
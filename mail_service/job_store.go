@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/RustamSafiulin/TimeTrackerService/mail_service/api"
+	"github.com/RustamSafiulin/TimeTrackerService/pkg/mail_sender"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	MailJobPending   = "pending"
+	MailJobSending   = "sending"
+	MailJobDelivered = "delivered"
+	MailJobFailed    = "failed"
+)
+
+//deliveredJobsTtl is how long delivered jobs are kept to answer status requests
+const deliveredJobsTtl = 7 * 24 * time.Hour
+
+var (
+	ErrJobNotFound    = errors.New("Mail job not found")
+	ErrNoJobs         = errors.New("No mail jobs ready to send")
+	ErrStorageError   = errors.New("Storage operation error")
+	ErrQueueSaturated = errors.New("Mail queue is full, try again later")
+)
+
+type MailJob struct {
+	Id             string    `bson:"_id"`
+	IdempotencyKey string    `bson:"idempotency_key,omitempty"`
+	From           string    `bson:"from"`
+	To             []string  `bson:"to"`
+	Subject        string    `bson:"subject"`
+	Body           string    `bson:"body"`
+	HtmlBody       string    `bson:"html_body,omitempty"`
+	Status         string    `bson:"status"`
+	Attempts       int       `bson:"attempts"`
+	NextAttemptAt  int64     `bson:"next_attempt_at"`
+	LockedUntil    int64     `bson:"locked_until,omitempty"`
+	LastError      string    `bson:"last_error,omitempty"`
+	CreatedAt      int64     `bson:"created_at"`
+	FailedAt       int64     `bson:"failed_at,omitempty"`
+	ExpireAt       time.Time `bson:"expire_at,omitempty"`
+}
+
+//unixMillis converts time to resolution of next_attempt_at and locked_until,
+//seconds would truncate short defers to current second and keep workers spinning
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func (job *MailJob) SenderRequest() *mail_sender.Request {
+	return &mail_sender.Request{
+		MessageId: job.Id,
+		From:      job.From,
+		To:        job.To,
+		Subject:   job.Subject,
+		Body:      job.Body,
+		HtmlBody:  job.HtmlBody,
+	}
+}
+
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts"`
+	//BaseDelay and MaxDelay are in seconds
+	BaseDelay int `json:"base_delay"`
+	MaxDelay  int `json:"max_delay"`
+	//Lease is how long claimed job is hidden from other workers, in seconds
+	Lease int `json:"lease"`
+}
+
+//backoff returns exponential delay before next attempt with random jitter up to 20%
+func (policy *RetryPolicy) backoff(attempts int) time.Duration {
+
+	delay := time.Duration(policy.BaseDelay) * time.Second
+	maxDelay := time.Duration(policy.MaxDelay) * time.Second
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+//MailJobStore keeps mail jobs in mongo, so they survive restart.
+//Jobs which exhausted attempts are moved to dead letters collection
+type MailJobStore struct {
+	mgoSession *mgo.Session
+	dbName     string
+	policy     RetryPolicy
+}
+
+func NewMailJobStore(url string, dbName string, policy RetryPolicy) *MailJobStore {
+
+	s, err := mgo.Dial(url)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return &MailJobStore{mgoSession: s, dbName: dbName, policy: policy}
+}
+
+func (store *MailJobStore) Close() {
+	store.mgoSession.Close()
+}
+
+func (store *MailJobStore) jobs() *mgo.Collection {
+	return store.mgoSession.DB(store.dbName).C("mail_jobs")
+}
+
+func (store *MailJobStore) deadLetters() *mgo.Collection {
+	return store.mgoSession.DB(store.dbName).C("mail_dead_letters")
+}
+
+func (store *MailJobStore) EnsureIndexes() error {
+
+	if err := store.jobs().EnsureIndex(mgo.Index{Key: []string{"status", "next_attempt_at"}, Background: true}); err != nil {
+		return err
+	}
+
+	if err := store.jobs().EnsureIndex(mgo.Index{Key: []string{"expire_at"}, ExpireAfter: time.Second, Background: true}); err != nil {
+		return err
+	}
+
+	if err := store.deadLetters().EnsureIndex(mgo.Index{Key: []string{"idempotency_key"}, Sparse: true, Background: true}); err != nil {
+		return err
+	}
+
+	return store.mgoSession.DB(store.dbName).Run(bson.D{
+		{Name: "createIndexes", Value: "mail_jobs"},
+		{Name: "indexes", Value: []bson.M{
+			{
+				"key":                     bson.M{"idempotency_key": 1},
+				"name":                    "unique_idempotency_key",
+				"unique":                  true,
+				"partialFilterExpression": bson.M{"idempotency_key": bson.M{"$exists": true}},
+			},
+		}},
+	}, nil)
+}
+
+//Insert stores new pending job. When job with the same idempotency key
+//already exists its id is returned and existed is true
+func (store *MailJobStore) Insert(job *MailJob) (messageId string, existed bool, err error) {
+
+	now := time.Now()
+	job.Status = MailJobPending
+	job.CreatedAt = now.Unix()
+	job.NextAttemptAt = unixMillis(now)
+
+	//failed job with the same key is in dead letters, it's sent again only by Replay
+	if job.IdempotencyKey != "" {
+		failed := MailJob{}
+		err := store.deadLetters().Find(bson.M{"idempotency_key": job.IdempotencyKey}).One(&failed)
+		if err == nil {
+			return failed.Id, true, nil
+		}
+
+		if err != mgo.ErrNotFound {
+			return "", false, ErrStorageError
+		}
+	}
+
+	err = store.jobs().Insert(job)
+	if err == nil {
+		return job.Id, false, nil
+	}
+
+	if !mgo.IsDup(err) || job.IdempotencyKey == "" {
+		return "", false, ErrStorageError
+	}
+
+	existing := MailJob{}
+	if err := store.jobs().Find(bson.M{"idempotency_key": job.IdempotencyKey}).One(&existing); err != nil {
+		return "", false, ErrStorageError
+	}
+
+	return existing.Id, true, nil
+}
+
+//Claim takes job ready to be sent and leases it to caller. Jobs left in
+//sending state by crashed worker become available after lease expiration
+func (store *MailJobStore) Claim() (*MailJob, error) {
+
+	now := unixMillis(time.Now())
+	query := bson.M{"$or": []bson.M{
+		{"status": MailJobPending, "next_attempt_at": bson.M{"$lte": now}},
+		{"status": MailJobSending, "locked_until": bson.M{"$lt": now}},
+	}}
+
+	job := MailJob{}
+	_, err := store.jobs().Find(query).Sort("next_attempt_at").Apply(mgo.Change{
+		Update: bson.M{"$set": bson.M{
+			"status":       MailJobSending,
+			"locked_until": now + int64(store.policy.Lease)*int64(time.Second/time.Millisecond),
+		}},
+		ReturnNew: true,
+	}, &job)
+
+	if err == mgo.ErrNotFound {
+		return nil, ErrNoJobs
+	}
+
+	if err != nil {
+		return nil, ErrStorageError
+	}
+
+	return &job, nil
+}
+
+func (store *MailJobStore) MarkDelivered(job *MailJob) error {
+
+	err := store.jobs().UpdateId(job.Id, bson.M{
+		"$set":   bson.M{"status": MailJobDelivered, "expire_at": time.Now().Add(deliveredJobsTtl)},
+		"$inc":   bson.M{"attempts": 1},
+		"$unset": bson.M{"locked_until": "", "last_error": ""},
+	})
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//MarkFailed schedules retry with exponential backoff or moves job to dead letters
+//when attempts are exhausted or error is permanent
+func (store *MailJobStore) MarkFailed(job *MailJob, sendErr error) error {
+
+	job.Attempts++
+	job.LastError = sendErr.Error()
+
+	//mail rejected by validation fails the same way on every attempt
+	if job.Attempts >= store.policy.MaxAttempts || mail_sender.IsPermanent(sendErr) {
+		job.Status = MailJobFailed
+		job.LockedUntil = 0
+		job.FailedAt = time.Now().Unix()
+
+		if _, err := store.deadLetters().UpsertId(job.Id, job); err != nil {
+			return ErrStorageError
+		}
+
+		if err := store.jobs().RemoveId(job.Id); err != nil && err != mgo.ErrNotFound {
+			return ErrStorageError
+		}
+
+		return nil
+	}
+
+	err := store.jobs().UpdateId(job.Id, bson.M{
+		"$set": bson.M{
+			"status":          MailJobPending,
+			"attempts":        job.Attempts,
+			"last_error":      job.LastError,
+			"next_attempt_at": unixMillis(time.Now().Add(store.policy.backoff(job.Attempts))),
+		},
+		"$unset": bson.M{"locked_until": ""},
+	})
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//Defer returns claimed job to queue until given time without counting attempt
+func (store *MailJobStore) Defer(job *MailJob, until time.Time) error {
+
+	err := store.jobs().UpdateId(job.Id, bson.M{
+		"$set":   bson.M{"status": MailJobPending, "next_attempt_at": unixMillis(until)},
+		"$unset": bson.M{"locked_until": ""},
+	})
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	return nil
+}
+
+//PendingCount returns number of jobs which are not delivered yet
+func (store *MailJobStore) PendingCount() (int, error) {
+
+	count, err := store.jobs().Find(bson.M{"status": bson.M{"$in": []string{MailJobPending, MailJobSending}}}).Count()
+	if err != nil {
+		return 0, ErrStorageError
+	}
+
+	return count, nil
+}
+
+func (store *MailJobStore) Status(messageId string) (api.MailDeliveryStatus, string, error) {
+
+	job := MailJob{}
+	err := store.jobs().FindId(messageId).One(&job)
+	if err == nil {
+		if job.Status == MailJobDelivered {
+			return api.MailDeliveryStatus_MailDelivered, "", nil
+		}
+
+		return api.MailDeliveryStatus_MailPending, job.LastError, nil
+	}
+
+	if err != mgo.ErrNotFound {
+		return 0, "", ErrStorageError
+	}
+
+	err = store.deadLetters().FindId(messageId).One(&job)
+	if err == mgo.ErrNotFound {
+		return 0, "", ErrJobNotFound
+	}
+
+	if err != nil {
+		return 0, "", ErrStorageError
+	}
+
+	return api.MailDeliveryStatus_MailFailed, job.LastError, nil
+}
+
+func (store *MailJobStore) ListDeadLetters(limit int, offset int) ([]MailJob, int, error) {
+
+	total, err := store.deadLetters().Count()
+	if err != nil {
+		return nil, 0, ErrStorageError
+	}
+
+	jobs := []MailJob{}
+	if err := store.deadLetters().Find(nil).Sort("-failed_at").Skip(offset).Limit(limit).All(&jobs); err != nil {
+		return nil, 0, ErrStorageError
+	}
+
+	return jobs, total, nil
+}
+
+//Replay puts dead letter back to queue with reset attempts counter
+func (store *MailJobStore) Replay(messageId string) error {
+
+	job := MailJob{}
+	err := store.deadLetters().FindId(messageId).One(&job)
+	if err == mgo.ErrNotFound {
+		return ErrJobNotFound
+	}
+
+	if err != nil {
+		return ErrStorageError
+	}
+
+	job.Status = MailJobPending
+	job.Attempts = 0
+	job.FailedAt = 0
+	job.NextAttemptAt = unixMillis(time.Now())
+
+	if _, err := store.jobs().UpsertId(job.Id, job); err != nil {
+		return ErrStorageError
+	}
+
+	if err := store.deadLetters().RemoveId(job.Id); err != nil && err != mgo.ErrNotFound {
+		return ErrStorageError
+	}
+
+	return nil
+}
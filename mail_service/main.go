@@ -1,10 +1,14 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/RustamSafiulin/TimeTrackerService/mail_service/api"
 	"github.com/RustamSafiulin/TimeTrackerService/pkg/mail_sender"
@@ -14,64 +18,109 @@ import (
 )
 
 var wg sync.WaitGroup
-var jobQueue SendMailJobQueue
+var jobQueue *SendMailJobQueue
+
+type Config struct {
+	ListenAddress string             `json:"listen_address"`
+	DbName        string             `json:"db_name"`
+	MongoUrl      string             `json:"mongodb_url"`
+	From          string             `json:"from"`
+	TemplatesDir  string             `json:"templates_dir"`
+	AdminToken    string             `json:"admin_token"`
+	Retry         RetryPolicy        `json:"retry"`
+	Queue         QueueConfig        `json:"queue"`
+	Smtp          mail_sender.Config `json:"smtp"`
+}
 
-type server struct{}
+func ReadConfiguration() *Config {
+	jsonFile, err := os.Open("config.json")
+	if err != nil {
+		panic(err.Error())
+	}
+	defer jsonFile.Close()
 
-type SendMailJob struct {
-	Body string
-}
+	byteValue, _ := ioutil.ReadAll(jsonFile)
+	var config Config
 
-type SendMailJobQueue struct {
-	mailJobChan chan SendMailJob
-}
+	err = json.Unmarshal(byteValue, &config)
+	if err != nil {
+		panic(err.Error())
+	}
 
-func (jq *SendMailJobQueue) AddTask(mailJob SendMailJob) {
-	jq.mailJobChan <- mailJob
-}
+	if config.ListenAddress == "" {
+		config.ListenAddress = ":3001"
+	}
 
-func (jq *SendMailJobQueue) RunLoop() {
+	if config.TemplatesDir == "" {
+		config.TemplatesDir = "templates"
+	}
 
-	go func() {
-		defer wg.Done()
+	if config.Retry.MaxAttempts <= 0 {
+		config.Retry.MaxAttempts = 5
+	}
 
-		for job := range jq.mailJobChan {
-			//send mail
-			log.Println(job.Body)
-			mail_sender.Send()
-		}
-	}()
-}
+	if config.Retry.BaseDelay <= 0 {
+		config.Retry.BaseDelay = 30
+	}
 
-func (s *server) SendMail(ctx context.Context, r *api.SendMailRequest) (*api.SendMailResponse, error) {
+	if config.Retry.MaxDelay < config.Retry.BaseDelay {
+		config.Retry.MaxDelay = 3600
+	}
 
-	jobQueue.AddTask(SendMailJob{Body: r.Body})
+	if config.Retry.Lease <= 0 {
+		config.Retry.Lease = 120
+	}
 
-	result := &api.SendMailResponse{}
-	result.SendStatus = api.SendMailStatus_MailQueuedSuccess
+	if config.Queue.Workers <= 0 {
+		config.Queue.Workers = 4
+	}
 
-	return result, nil
+	return &config
 }
 
 func main() {
 
-	wg.Add(1)
-	jobQueue.mailJobChan = make(chan SendMailJob, 200)
+	config := ReadConfiguration()
+
+	templates, err := LoadTemplates(config.TemplatesDir)
+	if err != nil {
+		log.Fatalf("Failed to load mail templates: %v", err)
+	}
+
+	store := NewMailJobStore(config.MongoUrl, config.DbName, config.Retry)
+	if err := store.EnsureIndexes(); err != nil {
+		log.Printf("Failed to create mail jobs indexes: %v", err)
+	}
+
+	wg.Add(config.Queue.Workers)
+	jobQueue = NewSendMailJobQueue(store, &config.Smtp, config.Queue)
 	jobQueue.RunLoop()
 
-	accepter, err := net.Listen("tcp", ":3001")
+	accepter, err := net.Listen("tcp", config.ListenAddress)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	s := grpc.NewServer()
-	api.RegisterMailServiceServer(s, &server{})
+	s := grpc.NewServer(grpc.UnaryInterceptor(adminAuthInterceptor(config.AdminToken)))
+	api.RegisterMailServiceServer(s, &server{config: config, templates: templates, store: store})
 	reflection.Register(s)
 
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %v, stopping", sig)
+
+		//GracefulStop waits for running calls, so accepted mails are already stored
+		s.GracefulStop()
+	}()
+
 	if err := s.Serve(accepter); err != nil {
 		log.Fatalf("Failed to server: %v", err)
 	}
 
-	close(jobQueue.mailJobChan)
+	//workers finish mails being sent, the rest stays pending in store until next start
+	jobQueue.Stop()
 	wg.Wait()
+	store.Close()
 }
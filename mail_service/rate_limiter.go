@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+//idleBucketTtl is how long bucket of domain without mails is kept
+const idleBucketTtl = 10 * time.Minute
+
+type RateLimits struct {
+	//GlobalRate and DomainRate are mails per second, zero means no limit
+	GlobalRate  float64 `json:"global_rate"`
+	GlobalBurst int     `json:"global_burst"`
+	DomainRate  float64 `json:"domain_rate"`
+	DomainBurst int     `json:"domain_burst"`
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+//delay refills bucket and returns how long to wait until token is available
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take() {
+	if b.rate > 0 {
+		b.tokens--
+	}
+}
+
+//RateLimiter limits mails sent to every recipient domain and to all domains together
+type RateLimiter struct {
+	mu      sync.Mutex
+	limits  RateLimits
+	global  *tokenBucket
+	domains map[string]*tokenBucket
+	calls   int
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:  limits,
+		global:  newTokenBucket(limits.GlobalRate, limits.GlobalBurst, time.Now()),
+		domains: map[string]*tokenBucket{},
+	}
+}
+
+func recipientDomains(recipients []string) []string {
+
+	seen := map[string]bool{}
+	domains := []string{}
+	for _, recipient := range recipients {
+		at := strings.LastIndex(recipient, "@")
+		if at == -1 {
+			continue
+		}
+
+		domain := strings.ToLower(strings.TrimRight(recipient[at+1:], ">"))
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
+
+//Reserve takes tokens for mail to recipients only when all limits allow it.
+//deferFor is set when some recipient domain is limited, so job should be put aside,
+//wait is set when only global limit is reached, so worker should wait and try again
+func (limiter *RateLimiter) Reserve(recipients []string) (wait time.Duration, deferFor time.Duration) {
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	limiter.prune(now)
+
+	buckets := []*tokenBucket{}
+	for _, domain := range recipientDomains(recipients) {
+		bucket, ok := limiter.domains[domain]
+		if !ok {
+			bucket = newTokenBucket(limiter.limits.DomainRate, limiter.limits.DomainBurst, now)
+			limiter.domains[domain] = bucket
+		}
+
+		if delay := bucket.delay(now); delay > deferFor {
+			deferFor = delay
+		}
+
+		buckets = append(buckets, bucket)
+	}
+
+	if deferFor > 0 {
+		return 0, deferFor
+	}
+
+	if wait = limiter.global.delay(now); wait > 0 {
+		return wait, 0
+	}
+
+	limiter.global.take()
+	for _, bucket := range buckets {
+		bucket.take()
+	}
+
+	return 0, 0
+}
+
+//prune periodically drops buckets of domains which weren't used for a while
+func (limiter *RateLimiter) prune(now time.Time) {
+
+	limiter.calls++
+	if limiter.calls%1000 != 0 {
+		return
+	}
+
+	for domain, bucket := range limiter.domains {
+		if now.Sub(bucket.last) > idleBucketTtl {
+			delete(limiter.domains, domain)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/mail"
+	"strings"
+
+	"github.com/RustamSafiulin/TimeTrackerService/mail_service/api"
+	"github.com/RustamSafiulin/TimeTrackerService/pkg/mail_sender"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//adminMethods expose recipients and bodies of failed mails and send them again,
+//they are called only with admin token
+var adminMethods = map[string]bool{
+	"/api.MailService/ListDeadLetters":  true,
+	"/api.MailService/ReplayDeadLetter": true,
+}
+
+type server struct {
+	config    *Config
+	templates MailTemplates
+	store     *MailJobStore
+}
+
+//adminAuthInterceptor checks "authorization: Bearer <admin_token>" metadata of admin calls.
+//Admin calls are rejected when admin token isn't configured
+func adminAuthInterceptor(adminToken string) grpc.UnaryServerInterceptor {
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+		if !adminMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		if adminToken == "" {
+			return nil, status.Error(codes.PermissionDenied, "Admin calls are disabled, admin_token isn't configured")
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			token := strings.TrimPrefix(value, "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+
+		return nil, status.Error(codes.Unauthenticated, "Invalid admin token")
+	}
+}
+
+func newMessageId() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func queueFailed(reason string) *api.SendMailResponse {
+	return &api.SendMailResponse{SendStatus: api.SendMailStatus_MailQueuedFailed, Reason: reason}
+}
+
+func (s *server) SendMail(ctx context.Context, r *api.SendMailRequest) (*api.SendMailResponse, error) {
+
+	if len(r.To) == 0 {
+		return queueFailed(mail_sender.ErrNoRecipients.Error()), nil
+	}
+
+	for _, to := range r.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return queueFailed("Bad recipient address " + to), nil
+		}
+	}
+
+	request := mail_sender.Request{
+		From:     s.config.From,
+		To:       r.To,
+		Subject:  r.Subject,
+		Body:     r.Body,
+		HtmlBody: r.HtmlBody,
+	}
+
+	if r.TemplateName != "" {
+		subject, text, html, err := s.templates.Render(r.TemplateName, r.TemplateVars)
+		if err != nil {
+			return queueFailed(err.Error()), nil
+		}
+
+		if request.Subject == "" {
+			request.Subject = subject
+		}
+
+		request.Body = text
+		request.HtmlBody = html
+	}
+
+	if request.Body == "" && request.HtmlBody == "" {
+		return queueFailed("Mail body is empty"), nil
+	}
+
+	messageId, _, err := jobQueue.AddTask(&MailJob{
+		Id:             newMessageId(),
+		IdempotencyKey: r.IdempotencyKey,
+		From:           request.From,
+		To:             request.To,
+		Subject:        request.Subject,
+		Body:           request.Body,
+		HtmlBody:       request.HtmlBody,
+	})
+
+	if err != nil {
+		return queueFailed(err.Error()), nil
+	}
+
+	return &api.SendMailResponse{SendStatus: api.SendMailStatus_MailQueuedSuccess, MessageId: messageId}, nil
+}
+
+func (s *server) GetMailStatus(ctx context.Context, r *api.GetMailStatusRequest) (*api.GetMailStatusResponse, error) {
+
+	deliveryStatus, errorText, err := s.store.Status(r.MessageId)
+	switch err {
+	case nil:
+		return &api.GetMailStatusResponse{MessageId: r.MessageId, Status: deliveryStatus, Error: errorText}, nil
+	case ErrJobNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (s *server) ListDeadLetters(ctx context.Context, r *api.ListDeadLettersRequest) (*api.ListDeadLettersResponse, error) {
+
+	limit := int(r.Limit)
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	offset := int(r.Offset)
+	if offset < 0 {
+		offset = 0
+	}
+
+	jobs, total, err := s.store.ListDeadLetters(limit, offset)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	result := &api.ListDeadLettersResponse{Total: int32(total)}
+	for _, job := range jobs {
+		result.DeadLetters = append(result.DeadLetters, &api.DeadLetter{
+			MessageId: job.Id,
+			To:        job.To,
+			Subject:   job.Subject,
+			Attempts:  int32(job.Attempts),
+			LastError: job.LastError,
+			FailedAt:  job.FailedAt,
+		})
+	}
+
+	return result, nil
+}
+
+func (s *server) ReplayDeadLetter(ctx context.Context, r *api.ReplayDeadLetterRequest) (*api.ReplayDeadLetterResponse, error) {
+
+	err := s.store.Replay(r.MessageId)
+	switch err {
+	case nil:
+		jobQueue.Wake()
+		return &api.ReplayDeadLetterResponse{MessageId: r.MessageId}, nil
+	case ErrJobNotFound:
+		return nil, status.Error(codes.NotFound, err.Error())
+	default:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+}
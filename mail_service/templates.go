@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+var ErrUnknownTemplate = errors.New("Unknown mail template")
+
+//MailTemplate is loaded from directory named after template with
+//subject.tmpl, body.txt.tmpl and optional body.html.tmpl files
+type MailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+type MailTemplates map[string]*MailTemplate
+
+func LoadTemplates(dir string) (MailTemplates, error) {
+
+	templates := MailTemplates{}
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return templates, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		templateDir := filepath.Join(dir, entry.Name())
+		mailTemplate := &MailTemplate{}
+
+		if mailTemplate.subject, err = texttemplate.ParseFiles(filepath.Join(templateDir, "subject.tmpl")); err != nil {
+			return nil, err
+		}
+
+		if mailTemplate.text, err = texttemplate.ParseFiles(filepath.Join(templateDir, "body.txt.tmpl")); err != nil {
+			return nil, err
+		}
+
+		htmlPath := filepath.Join(templateDir, "body.html.tmpl")
+		if _, err := os.Stat(htmlPath); err == nil {
+			if mailTemplate.html, err = htmltemplate.ParseFiles(htmlPath); err != nil {
+				return nil, err
+			}
+		}
+
+		templates[entry.Name()] = mailTemplate
+	}
+
+	return templates, nil
+}
+
+func (templates MailTemplates) Render(name string, vars map[string]string) (subject string, text string, html string, err error) {
+
+	mailTemplate, ok := templates[name]
+	if !ok {
+		return "", "", "", ErrUnknownTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := mailTemplate.subject.Execute(&buf, vars); err != nil {
+		return "", "", "", err
+	}
+	//subject goes to mail header, so it must be single line
+	subject = strings.Join(strings.Fields(buf.String()), " ")
+
+	buf.Reset()
+	if err := mailTemplate.text.Execute(&buf, vars); err != nil {
+		return "", "", "", err
+	}
+	text = buf.String()
+
+	if mailTemplate.html != nil {
+		buf.Reset()
+		if err := mailTemplate.html.Execute(&buf, vars); err != nil {
+			return "", "", "", err
+		}
+		html = buf.String()
+	}
+
+	return subject, text, html, nil
+}
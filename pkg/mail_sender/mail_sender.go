@@ -1,19 +1,467 @@
 package mail_sender
 
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Connection security modes
+const (
+	SecurityNone     = "none"
+	SecurityStartTLS = "starttls"
+	SecurityTLS      = "tls"
+)
+
+//Authentication mechanisms
+const (
+	AuthNone  = "none"
+	AuthPlain = "plain"
+	AuthLogin = "login"
+)
+
+var (
+	ErrNoRecipients   = errors.New("Mail has no recipients")
+	ErrNoSender       = errors.New("Mail has no sender")
+	ErrUnknownAuth    = errors.New("Unknown smtp auth mechanism")
+	ErrUnknownSecure  = errors.New("Unknown smtp connection security")
+	ErrStartTLSNotSup = errors.New("Smtp server doesn't support STARTTLS")
+	ErrHeaderNewline  = errors.New("Mail header value contains line break")
+	ErrBadAddress     = errors.New("Bad mail address")
+)
+
 type Config struct {
-	Server   string
-	Port     int
-	Emai     string
-	Password string
+	Server   string `json:"server"`
+	Port     int    `json:"port"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+
+	//Security is none, starttls or tls (implicit TLS, usually port 465).
+	//Empty value means starttls
+	Security string `json:"security"`
+	//Auth is none, plain or login. Empty value means plain when password is set
+	Auth string `json:"auth"`
+	//HelloName is sent in EHLO, empty value means localhost
+	HelloName string `json:"hello_name"`
+	//Timeout of smtp conversation in seconds, 30 by default
+	Timeout int `json:"timeout"`
+
+	//TLSConfig overrides default tls settings, e.g. to trust certificate of local test server
+	TLSConfig *tls.Config `json:"-"`
+}
+
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
 }
 
 type Request struct {
-	From    string
-	To      []string
-	Subject string
-	Body    string
+	//MessageId is local part of Message-ID header, random one is used when empty
+	MessageId   string
+	From        string
+	To          []string
+	Subject     string
+	Body        string
+	HtmlBody    string
+	Attachments []Attachment
+}
+
+//IsPermanent tells that request is rejected before connecting to server and retries won't help
+func IsPermanent(err error) bool {
+
+	switch err {
+	case ErrNoRecipients, ErrNoSender, ErrBadAddress, ErrHeaderNewline:
+		return true
+	default:
+		return false
+	}
+}
+
+//Send delivers request to smtp server described by config
+func Send(config *Config, request *Request) error {
+
+	if len(request.To) == 0 {
+		return ErrNoRecipients
+	}
+
+	from := request.From
+	if from == "" {
+		from = config.Email
+	}
+
+	if from == "" {
+		return ErrNoSender
+	}
+
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return ErrBadAddress
+	}
+
+	recipients := make([]string, 0, len(request.To))
+	for _, to := range request.To {
+		address, err := mail.ParseAddress(to)
+		if err != nil {
+			return ErrBadAddress
+		}
+
+		recipients = append(recipients, address.Address)
+	}
+
+	message, err := BuildMessage(from, request)
+	if err != nil {
+		return err
+	}
+
+	client, err := dial(config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := authenticate(client, config); err != nil {
+		return err
+	}
+
+	if err := client.Mail(fromAddress.Address); err != nil {
+		return err
+	}
+
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(message); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func dial(config *Config) (*smtp.Client, error) {
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	address := net.JoinHostPort(config.Server, strconv.Itoa(config.Port))
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: config.Server}
+	}
+
+	var conn net.Conn
+	var err error
+
+	security := config.Security
+	switch security {
+	case SecurityTLS:
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, tlsConfig)
+	case "", SecurityStartTLS, SecurityNone:
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	default:
+		return nil, ErrUnknownSecure
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	client, err := smtp.NewClient(conn, config.Server)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	helloName := config.HelloName
+	if helloName == "" {
+		helloName = "localhost"
+	}
+
+	if err := client.Hello(helloName); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	if security == "" || security == SecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, ErrStartTLSNotSup
+		}
+
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func authenticate(client *smtp.Client, config *Config) error {
+
+	mechanism := config.Auth
+	if mechanism == "" {
+		mechanism = AuthPlain
+		if config.Password == "" {
+			mechanism = AuthNone
+		}
+	}
+
+	switch mechanism {
+	case AuthNone:
+		return nil
+	case AuthPlain:
+		return client.Auth(smtp.PlainAuth("", config.Email, config.Password, config.Server))
+	case AuthLogin:
+		return client.Auth(&loginAuth{username: config.Email, password: config.Password})
+	default:
+		return ErrUnknownAuth
+	}
+}
+
+//loginAuth implements LOGIN mechanism which net/smtp doesn't provide
+type loginAuth struct {
+	username string
+	password string
 }
 
-func Send() {
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+	}
+}
+
+//BuildMessage makes MIME message. Text and html bodies are put into
+//multipart/alternative part, attachments make message multipart/mixed
+func BuildMessage(from string, request *Request) ([]byte, error) {
+
+	//values are written to headers as is, line break would let caller add own headers
+	values := append([]string{from, request.Subject, request.MessageId}, request.To...)
+	for _, attachment := range request.Attachments {
+		values = append(values, attachment.Filename, attachment.ContentType)
+	}
+
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, ErrHeaderNewline
+		}
+	}
+
+	var buf bytes.Buffer
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", from)
+	header.Set("To", strings.Join(request.To, ", "))
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", request.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", messageId(request.MessageId, from))
+	header.Set("MIME-Version", "1.0")
+
+	bodyHeader, body, err := buildBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(request.Attachments) == 0 {
+		for key, values := range bodyHeader {
+			header[key] = values
+		}
+
+		writeHeader(&buf, header)
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	header.Set("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	writeHeader(&buf, header)
+
+	part, err := mixed.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := part.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range request.Attachments {
+		contentType := attachment.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})},
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := writeBase64(part, attachment.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+//buildBody returns content headers and encoded text, html or alternative body
+func buildBody(request *Request) (textproto.MIMEHeader, []byte, error) {
+
+	var buf bytes.Buffer
+
+	if request.HtmlBody == "" {
+		header := textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}
+
+		if err := writeQuotedPrintable(&buf, request.Body); err != nil {
+			return nil, nil, err
+		}
+
+		return header, buf.Bytes(), nil
+	}
+
+	alternative := multipart.NewWriter(&buf)
+	header := textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	}
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", request.Body},
+		{"text/html; charset=utf-8", request.HtmlBody},
+	}
+
+	for _, p := range parts {
+		part, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := writeQuotedPrintable(part, p.body); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err := alternative.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	return header, buf.Bytes(), nil
+}
+
+func writeHeader(w io.Writer, header textproto.MIMEHeader) {
+	for key, values := range header {
+		for _, value := range values {
+			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+		}
+	}
+
+	io.WriteString(w, "\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := io.WriteString(qp, text); err != nil {
+		return err
+	}
+
+	return qp.Close()
+}
+
+//writeBase64 writes data in lines of 76 characters
+func writeBase64(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+
+		encoded = encoded[76:]
+	}
+
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+func messageId(id string, from string) string {
+	domain := "localhost"
+	if address, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(address.Address, "@"); at != -1 {
+			domain = address.Address[at+1:]
+		}
+	}
+
+	if id == "" {
+		buf := make([]byte, 16)
+		rand.Read(buf)
+		id = hex.EncodeToString(buf)
+	}
 
+	return "<" + id + "@" + domain + ">"
 }
@@ -0,0 +1,401 @@
+package mail_sender
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "sender@example.com"
+	testPassword = "secret"
+)
+
+//smtpStub is minimal in-process smtp server which records delivered mail
+type smtpStub struct {
+	t         *testing.T
+	listener  net.Listener
+	tlsConfig *tls.Config
+	security  string
+	delivered chan *delivery
+}
+
+type delivery struct {
+	tls        bool
+	mechanism  string
+	from       string
+	recipients []string
+	data       string
+}
+
+func newSmtpStub(t *testing.T, security string) (*smtpStub, *Config) {
+
+	cert, pool := testCertificate(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if security == SecurityTLS {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+
+	stub := &smtpStub{t: t, listener: listener, tlsConfig: serverTLS, security: security, delivered: make(chan *delivery, 1)}
+	go stub.serve()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	return stub, &Config{
+		Server:    host,
+		Port:      portNumber,
+		Email:     testUser,
+		Password:  testPassword,
+		Security:  security,
+		Timeout:   5,
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: host},
+	}
+}
+
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func (stub *smtpStub) serve() {
+
+	for {
+		conn, err := stub.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go stub.handle(conn)
+	}
+}
+
+func (stub *smtpStub) handle(conn net.Conn) {
+
+	defer conn.Close()
+
+	_, secure := conn.(*tls.Conn)
+	result := &delivery{}
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	readLine := func() string {
+		line, _ := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n")
+	}
+
+	reply("220 stub ready")
+	for {
+		line := readLine()
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch command {
+		case "EHLO":
+			reply("250-stub")
+			if !secure && stub.security != SecurityTLS {
+				reply("250-STARTTLS")
+			}
+			reply("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			reply("220 go ahead")
+			tlsConn := tls.Server(conn, stub.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+
+			conn, secure = tlsConn, true
+			r = bufio.NewReader(conn)
+		case "AUTH":
+			fields := strings.Fields(line)
+			result.mechanism = strings.ToUpper(fields[1])
+
+			var username, password string
+			switch result.mechanism {
+			case "PLAIN":
+				decoded, _ := base64.StdEncoding.DecodeString(fields[2])
+				parts := strings.Split(string(decoded), "\x00")
+				username, password = parts[1], parts[2]
+			case "LOGIN":
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				decoded, _ := base64.StdEncoding.DecodeString(readLine())
+				username = string(decoded)
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				decoded, _ = base64.StdEncoding.DecodeString(readLine())
+				password = string(decoded)
+			}
+
+			if username != testUser || password != testPassword {
+				reply("535 authentication failed")
+				continue
+			}
+
+			reply("235 authenticated")
+		case "MAIL":
+			result.from = line[len("MAIL FROM:"):]
+			reply("250 ok")
+		case "RCPT":
+			result.recipients = append(result.recipients, line[len("RCPT TO:"):])
+			reply("250 ok")
+		case "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				dataLine := readLine()
+				if dataLine == "." {
+					break
+				}
+
+				data.WriteString(strings.TrimPrefix(dataLine, ".") + "\r\n")
+			}
+
+			result.data = data.String()
+			result.tls = secure
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			stub.delivered <- result
+			return
+		default:
+			reply("502 not implemented")
+			return
+		}
+	}
+}
+
+func (stub *smtpStub) wait() *delivery {
+
+	select {
+	case result := <-stub.delivered:
+		return result
+	case <-time.After(5 * time.Second):
+		stub.t.Fatal("mail wasn't delivered to stub")
+		return nil
+	}
+}
+
+func TestSendStartTLSPlainAuth(t *testing.T) {
+
+	stub, config := newSmtpStub(t, SecurityStartTLS)
+	defer stub.listener.Close()
+
+	err := Send(config, &Request{To: []string{"Receiver <to@example.com>"}, Subject: "Hello", Body: "text body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := stub.wait()
+	if !result.tls || result.mechanism != "PLAIN" {
+		t.Fatalf("expected PLAIN auth over STARTTLS, got tls=%v mechanism=%s", result.tls, result.mechanism)
+	}
+
+	if result.from != "<"+testUser+">" || len(result.recipients) != 1 || result.recipients[0] != "<to@example.com>" {
+		t.Fatalf("unexpected envelope %s -> %v", result.from, result.recipients)
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(result.data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(message.Body)
+	if !strings.HasPrefix(message.Header.Get("Content-Type"), "text/plain") || strings.TrimSpace(string(body)) != "text body" {
+		t.Fatalf("unexpected body %q of type %s", body, message.Header.Get("Content-Type"))
+	}
+}
+
+func TestSendImplicitTLSLoginAuth(t *testing.T) {
+
+	stub, config := newSmtpStub(t, SecurityTLS)
+	defer stub.listener.Close()
+	config.Auth = AuthLogin
+
+	if err := Send(config, &Request{To: []string{"to@example.com"}, Subject: "Hello", Body: "text"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result := stub.wait()
+	if !result.tls || result.mechanism != "LOGIN" {
+		t.Fatalf("expected LOGIN auth over implicit TLS, got tls=%v mechanism=%s", result.tls, result.mechanism)
+	}
+}
+
+func TestSendWrongPassword(t *testing.T) {
+
+	stub, config := newSmtpStub(t, SecurityTLS)
+	defer stub.listener.Close()
+	config.Auth = AuthLogin
+	config.Password = "wrong"
+
+	if err := Send(config, &Request{To: []string{"to@example.com"}, Body: "text"}); err == nil {
+		t.Fatal("expected authentication error")
+	}
+}
+
+func TestLoginAuthRequiresTLS(t *testing.T) {
+
+	auth := &loginAuth{username: testUser, password: testPassword}
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "127.0.0.1", Auth: []string{"LOGIN"}}); err == nil {
+		t.Fatal("LOGIN auth must not be used without TLS")
+	}
+}
+
+func TestSendAlternativeWithAttachments(t *testing.T) {
+
+	stub, config := newSmtpStub(t, SecurityStartTLS)
+	defer stub.listener.Close()
+
+	err := Send(config, &Request{
+		To:       []string{"to@example.com"},
+		Subject:  "Отчёт",
+		Body:     "plain text",
+		HtmlBody: "<p>html text</p>",
+		Attachments: []Attachment{
+			{Filename: "report.csv", ContentType: "text/csv", Data: []byte("a,b\n1,2\n")},
+			{Filename: "data.bin", Data: []byte{0, 1, 2, 3}},
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(stub.wait().data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject")); err != nil || subject != "Отчёт" {
+		t.Fatalf("unexpected subject %q: %v", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %s: %v", mediaType, err)
+	}
+
+	mixed := multipart.NewReader(message.Body, params["boundary"])
+
+	bodyPart, err := mixed.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaType, bodyParams, err := mime.ParseMediaType(bodyPart.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative body, got %s: %v", mediaType, err)
+	}
+
+	alternative := multipart.NewReader(bodyPart, bodyParams["boundary"])
+	for _, expected := range []struct{ contentType, body string }{
+		{"text/plain", "plain text"},
+		{"text/html", "<p>html text</p>"},
+	} {
+		part, err := alternative.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(part)
+		if !strings.HasPrefix(part.Header.Get("Content-Type"), expected.contentType) || string(body) != expected.body {
+			t.Fatalf("unexpected alternative part %s %q", part.Header.Get("Content-Type"), body)
+		}
+	}
+
+	for _, expected := range []struct{ filename, contentType, data string }{
+		{"report.csv", "text/csv", "a,b\n1,2\n"},
+		{"data.bin", "application/octet-stream", "\x00\x01\x02\x03"},
+	} {
+		part, err := mixed.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded, _ := ioutil.ReadAll(part)
+		data, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if part.FileName() != expected.filename || part.Header.Get("Content-Type") != expected.contentType || string(data) != expected.data {
+			t.Fatalf("unexpected attachment %s %s %q", part.FileName(), part.Header.Get("Content-Type"), data)
+		}
+	}
+
+	if _, err := mixed.NextPart(); err == nil {
+		t.Fatal("unexpected extra part")
+	}
+}
+
+func TestBuildMessageRejectsHeaderNewlines(t *testing.T) {
+
+	requests := []*Request{
+		{To: []string{"to@example.com"}, Subject: "Hello\r\nBcc: victim@example.com"},
+		{To: []string{"to@example.com\nBcc: victim@example.com"}},
+		{To: []string{"to@example.com"}, MessageId: "id\r\nBcc: victim@example.com"},
+		{To: []string{"to@example.com"}, Attachments: []Attachment{{Filename: "a.txt\r\nX-Injected: 1"}}},
+	}
+
+	for _, request := range requests {
+		if _, err := BuildMessage(testUser, request); err != ErrHeaderNewline {
+			t.Fatalf("expected ErrHeaderNewline for %+v, got %v", request, err)
+		}
+	}
+
+	if _, err := BuildMessage(testUser+"\r\nBcc: victim@example.com", &Request{To: []string{"to@example.com"}}); err != ErrHeaderNewline {
+		t.Fatalf("expected ErrHeaderNewline for sender, got %v", err)
+	}
+
+	err := Send(&Config{Server: "127.0.0.1", Port: 1}, &Request{From: testUser, To: []string{"to@example.com"}, Subject: "a\nb"})
+	if err != ErrHeaderNewline || !IsPermanent(err) {
+		t.Fatalf("expected permanent ErrHeaderNewline before connecting, got %v", err)
+	}
+}